@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/afoninsky/yeelight/yeelight"
+)
+
+// lamp is a configured Yeelight together with the runner driving it
+type lamp struct {
+	yeelight *yeelight.Yeelight
+	runner   *yeelight.ScriptRunner
+}
+
+// addLamp registers a lamp by address, ignoring duplicates. pool may be
+// nil to dial per command.
+func addLamp(addr string, pool *yeelight.ConnPool) {
+	if _, ok := lamps[addr]; ok {
+		return
+	}
+
+	cfg := yeelight.DefaultClientConfig()
+	cfg.Pool = pool
+	cfg.Geometry = geometry
+	yl := yeelight.NewYeelight(addr, cfg)
+	lamps[addr] = &lamp{yeelight: yl, runner: yeelight.NewScriptRunner(yl)}
+	lampAddrs = append(lampAddrs, addr)
+}
+
+// requestLamp returns the lamp selected by the lamp query parameter, or the
+// first configured lamp when the parameter is missing. An unknown lamp is
+// answered with 404 Not Found.
+func requestLamp(w http.ResponseWriter, r *http.Request) (*lamp, bool) {
+	addr := r.URL.Query().Get("lamp")
+	if addr == "" {
+		return lamps[lampAddrs[0]], true
+	}
+
+	l, ok := lamps[addr]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Lamp not found: %s", addr), http.StatusNotFound)
+	}
+	return l, ok
+}
+
+func handleListLamps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Return plain text list of lamp ids
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, strings.Join(lampAddrs, "\n"))
+}
+
+// handleLampActions serves /lamps/<id>/scripts/<name>/<action> and
+// /lamps/<id>/status, where id is the lamp address as configured
+func handleLampActions(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/lamps/")
+	parts := strings.Split(path, "/")
+
+	if len(parts) == 2 && parts[1] == "status" {
+		l, ok := lamps[parts[0]]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Lamp not found: %s", parts[0]), http.StatusNotFound)
+			return
+		}
+		handleRunnerStatus(w, r, l.runner)
+		return
+	}
+
+	if len(parts) < 4 || parts[1] != "scripts" {
+		http.Error(w, "Invalid URL format", http.StatusBadRequest)
+		return
+	}
+
+	l, ok := lamps[parts[0]]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Lamp not found: %s", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	scriptName := parts[2]
+	action := parts[3]
+
+	// Built-in scripts without a file
+	if action == "run" && handleRunBuiltin(w, r, l.runner, scriptName) {
+		return
+	}
+
+	switch action {
+	case "run":
+		handleRunScript(w, r, l.runner, scriptName)
+	case "stop":
+		handleStopScript(w, r, l.runner, scriptName)
+	case "frame":
+		handleShowFrame(w, r, l.runner, scriptName)
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+	}
+}
@@ -1,40 +1,101 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/afoninsky/yeelight/yeelight"
 )
 
 var (
-	// Global script runner for HTTP mode
+	// Script runner of the first lamp, used by the CLI
 	globalRunner *yeelight.ScriptRunner
-	// Global Yeelight instance
+	// Yeelight instance of the first lamp, used by the CLI
 	globalYeelight *yeelight.Yeelight
-	// Scripts path
+	// All configured lamps by address, the first one is the global lamp
+	lamps = map[string]*lamp{}
+	// Lamp addresses in configuration order
+	lampAddrs []string
+	// Scripts path (the default library)
 	scriptsPath string
+	// All configured script libraries
+	scriptLibraries []string
+	// LED layout of the lamps, scripts are parsed for it
+	geometry = yeelight.DefaultGeometry
 )
 
 func main() {
 	// Parse command line flags
 	httpMode := flag.Bool("http", false, "Run in HTTP server mode")
+	dumpASCII := flag.String("dump-ascii", "", "Print the update_leds payload of a script frame and exit")
+	validate := flag.String("validate", "", "Parse a script, print any warnings and exit")
+	benchmark := flag.Int("benchmark", 0, "Send N get_prop commands, print round-trip statistics and exit")
+	discover := flag.Bool("discover", false, "Search the LAN for lamps, print them and exit")
 	flag.Parse()
 
-	// Get environment variables
-	yeelightAddr := os.Getenv("YEELIGHT_ADDR")
-	if yeelightAddr == "" {
+	// YEELIGHT_SCRIPTS may list several libraries separated by colons
+	for _, dir := range strings.Split(os.Getenv("YEELIGHT_SCRIPTS"), ":") {
+		if dir != "" {
+			scriptLibraries = append(scriptLibraries, dir)
+		}
+	}
+	if len(scriptLibraries) == 0 {
+		scriptLibraries = []string{"./scripts"}
+	}
+	scriptsPath = scriptLibraries[0]
+
+	// YEELIGHT_GEOMETRY is rows x columns for panels other than 5x5
+	if value := os.Getenv("YEELIGHT_GEOMETRY"); value != "" {
+		g, err := yeelight.ParseGeometry(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		geometry = g
+	}
+
+	// Diagnostics that don't need the lamp
+	if *dumpASCII != "" {
+		runDumpASCII(*dumpASCII, flag.Args())
+		return
+	}
+	if *validate != "" {
+		runValidate(*validate)
+		return
+	}
+	if *discover {
+		runDiscover()
+		return
+	}
+
+	// Get environment variables, YEELIGHT_ADDRS may list several lamps
+	// separated by commas
+	var addrs []string
+	if yeelightAddr := os.Getenv("YEELIGHT_ADDR"); yeelightAddr != "" {
+		addrs = append(addrs, yeelightAddr)
+	}
+	for _, addr := range strings.Split(os.Getenv("YEELIGHT_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
 		log.Fatal("YEELIGHT_ADDR env is not set")
 	}
 
@@ -43,18 +104,36 @@ func main() {
 		httpAddr = ":3048"
 	}
 
-	scriptsPath = os.Getenv("YEELIGHT_SCRIPTS")
-	if scriptsPath == "" {
-		scriptsPath = "./scripts"
+	// Initialize lamps, the first one is used by the CLI and by endpoints
+	// without a lamp parameter.
+	// With several lamps the connections are kept open in a shared pool.
+	var pool *yeelight.ConnPool
+	if len(addrs) > 1 {
+		pool = yeelight.NewConnPool(0)
+		defer pool.Close()
 	}
+	for _, addr := range addrs {
+		addLamp(addr, pool)
+	}
+	globalYeelight = lamps[lampAddrs[0]].yeelight
+	globalRunner = lamps[lampAddrs[0]].runner
 
-	// Initialize Yeelight
-	globalYeelight = &yeelight.Yeelight{Address: yeelightAddr}
-	globalRunner = yeelight.NewScriptRunner(globalYeelight)
+	// Check that the lamps answer commands
+	for _, addr := range lampAddrs {
+		if err := lamps[addr].yeelight.Probe(); err != nil {
+			log.Printf("Warning: %s: %v", addr, err)
+		}
+	}
+
+	if *benchmark > 0 {
+		runBenchmark(*benchmark)
+		return
+	}
 
 	// Decide which mode to run
 	if *httpMode || os.Getenv("YEELIGHT_HTTP") != "" {
 		// Run in HTTP server mode
+		checkScriptLibraries()
 		runHTTPServer(httpAddr)
 	} else {
 		// Run in CLI mode
@@ -66,6 +145,20 @@ func runHTTPServer(addr string) {
 	// Set up HTTP routes
 	http.HandleFunc("/yeelight", handleListScripts)
 	http.HandleFunc("/yeelight/", handleScriptActions)
+	http.HandleFunc("/yeelight/playlist", handlePlaylist)
+	http.HandleFunc("/yeelight/status", func(w http.ResponseWriter, r *http.Request) {
+		if l, ok := requestLamp(w, r); ok {
+			handleRunnerStatus(w, r, l.runner)
+		}
+	})
+	http.HandleFunc("/lamp/stream", handleLampStream)
+	http.HandleFunc("/lamp/properties", handleLampProperties)
+	http.HandleFunc("/lamp/raw", handleLampRaw)
+	http.HandleFunc("/lamp/snapshot/", handleLampSnapshot)
+	http.HandleFunc("/lamp/restore/", handleLampRestore)
+	http.HandleFunc("/status/effects", handleStatusEffects)
+	http.HandleFunc("/lamps", handleListLamps)
+	http.HandleFunc("/lamps/", handleLampActions)
 
 	// Create server
 	srv := &http.Server{
@@ -91,14 +184,21 @@ func runHTTPServer(addr string) {
 	<-stop
 	log.Println("Shutting down server...")
 
-	// Stop any running script
-	if err := globalRunner.StopScript(); err != nil {
-		log.Printf("Failed to stop script during shutdown: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Stop any running scripts and wait until the lamps are left turned off
+	for _, addr := range lampAddrs {
+		runner := lamps[addr].runner
+		if !runner.IsRunning() {
+			continue
+		}
+		if err := runner.StopAndWait(ctx); err != nil {
+			log.Printf("Failed to stop script on %s during shutdown: %v", addr, err)
+		}
 	}
 
 	// Shutdown server with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
@@ -112,8 +212,18 @@ func handleListScripts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dir, err := scriptsDir(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	// Read scripts directory
-	files, err := ioutil.ReadDir(scriptsPath)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Scripts directory not found: %s (set YEELIGHT_SCRIPTS)", dir), http.StatusInternalServerError)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to read scripts directory: %v", err), http.StatusInternalServerError)
 		return
@@ -128,6 +238,9 @@ func handleListScripts(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Built-in scripts
+	scripts = append(scripts, yeelight.ClockScriptName, yeelight.DemoScriptName)
+
 	// Return plain text list
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
@@ -138,7 +251,7 @@ func handleScriptActions(w http.ResponseWriter, r *http.Request) {
 	// Extract script name and action from URL
 	path := strings.TrimPrefix(r.URL.Path, "/yeelight/")
 	parts := strings.Split(path, "/")
-	
+
 	if len(parts) < 2 {
 		http.Error(w, "Invalid URL format", http.StatusBadRequest)
 		return
@@ -147,29 +260,49 @@ func handleScriptActions(w http.ResponseWriter, r *http.Request) {
 	scriptName := parts[0]
 	action := parts[1]
 
+	if action == "validate" {
+		handleValidateScript(w, r, scriptName)
+		return
+	}
+
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	// Built-in scripts without a file
+	if action == "run" && handleRunBuiltin(w, r, l.runner, scriptName) {
+		return
+	}
+
 	switch action {
 	case "run":
-		handleRunScript(w, r, scriptName)
+		handleRunScript(w, r, l.runner, scriptName)
 	case "stop":
-		handleStopScript(w, r, scriptName)
+		handleStopScript(w, r, l.runner, scriptName)
+	case "frame":
+		handleShowFrame(w, r, l.runner, scriptName)
 	default:
 		http.Error(w, "Unknown action", http.StatusNotFound)
 	}
 }
 
-func handleRunScript(w http.ResponseWriter, r *http.Request, scriptName string) {
+func handleRunScript(w http.ResponseWriter, r *http.Request, runner *yeelight.ScriptRunner, scriptName string) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse query parameters
-	intervalMs := 500
+	// Parse query parameters (an explicit interval of 0 shows the first
+	// frame statically)
+	intervalMs := 0
+	intervalGiven := false
 	timeoutSec := 0
 
 	if intervalStr := r.URL.Query().Get("interval"); intervalStr != "" {
-		if val, err := strconv.Atoi(intervalStr); err == nil && val > 0 {
+		if val, err := strconv.Atoi(intervalStr); err == nil && val >= 0 {
 			intervalMs = val
+			intervalGiven = true
 		}
 	}
 
@@ -179,8 +312,18 @@ func handleRunScript(w http.ResponseWriter, r *http.Request, scriptName string)
 		}
 	}
 
+	mode, err := yeelight.ParsePlayMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid mode: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	// Build script path
-	scriptPath := filepath.Join(scriptsPath, scriptName+".txt")
+	scriptPath, status, err := resolveScript(r, scriptName)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
 
 	// Check if script exists
 	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
@@ -188,14 +331,19 @@ func handleRunScript(w http.ResponseWriter, r *http.Request, scriptName string)
 		return
 	}
 
+	// Without an explicit interval use the one recommended by the script
+	if !intervalGiven {
+		intervalMs = int(defaultInterval(scriptPath) / time.Millisecond)
+	}
+
 	// Stop any currently running script
-	globalRunner.StopScript()
+	runner.StopScript()
 
 	// Run the new script
 	interval := time.Duration(intervalMs) * time.Millisecond
 	timeout := time.Duration(timeoutSec) * time.Second
 
-	if err := globalRunner.RunScript(scriptPath, interval, timeout); err != nil {
+	if err := runner.RunScriptWithMode(scriptPath, interval, timeout, mode); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to run script: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -203,17 +351,567 @@ func handleRunScript(w http.ResponseWriter, r *http.Request, scriptName string)
 	// Return success response
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Script %s started (interval: %dms, timeout: %ds)\n", scriptName, intervalMs, timeoutSec)
+	fmt.Fprintf(w, "Script %s started (interval: %dms, timeout: %ds, mode: %s)\n", scriptName, intervalMs, timeoutSec, mode)
+}
+
+// handleRunBuiltin starts a built-in script and reports whether scriptName
+// named one
+func handleRunBuiltin(w http.ResponseWriter, r *http.Request, runner *yeelight.ScriptRunner, scriptName string) bool {
+	switch scriptName {
+	case yeelight.ClockScriptName:
+		handleRunClock(w, r, runner)
+	case yeelight.DemoScriptName:
+		handleRunDemo(w, r, runner)
+	default:
+		return false
+	}
+	return true
+}
+
+// handleRunDemo starts the built-in demo script
+func handleRunDemo(w http.ResponseWriter, r *http.Request, runner *yeelight.ScriptRunner) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	intervalMs := int(yeelight.DemoInterval / time.Millisecond)
+	timeoutSec := 0
+
+	if intervalStr := r.URL.Query().Get("interval"); intervalStr != "" {
+		if val, err := strconv.Atoi(intervalStr); err == nil && val > 0 {
+			intervalMs = val
+		}
+	}
+
+	if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+		if val, err := strconv.Atoi(timeoutStr); err == nil && val >= 0 {
+			timeoutSec = val
+		}
+	}
+
+	// Stop any currently running script
+	runner.StopScript()
+
+	interval := time.Duration(intervalMs) * time.Millisecond
+	timeout := time.Duration(timeoutSec) * time.Second
+
+	if err := runner.RunDemo(interval, timeout); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to run demo: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Return success response
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Script %s started (interval: %dms, timeout: %ds)\n", yeelight.DemoScriptName, intervalMs, timeoutSec)
+}
+
+// handleRunClock starts the built-in clock script
+func handleRunClock(w http.ResponseWriter, r *http.Request, runner *yeelight.ScriptRunner) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeoutSec := 0
+	if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+		if val, err := strconv.Atoi(timeoutStr); err == nil && val >= 0 {
+			timeoutSec = val
+		}
+	}
+
+	// Stop any currently running script
+	runner.StopScript()
+
+	if err := runner.RunClock(time.Duration(timeoutSec) * time.Second); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to run clock: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Return success response
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Script %s started (timeout: %ds)\n", yeelight.ClockScriptName, timeoutSec)
+}
+
+// playlistRequest is the body of a playlist request
+type playlistRequest struct {
+	Scripts  []string `json:"scripts"`
+	Interval int      `json:"interval"`
+	Loops    int      `json:"loops"`
+}
+
+func handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req playlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid playlist: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scripts) == 0 {
+		http.Error(w, "Playlist must contain at least one script", http.StatusBadRequest)
+		return
+	}
+	if req.Interval <= 0 {
+		req.Interval = 500
+	}
+	if req.Loops < 0 {
+		http.Error(w, "Loops must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	// Resolve script paths
+	var scriptPaths []string
+	for _, scriptName := range req.Scripts {
+		scriptPath, status, err := resolveScript(r, scriptName)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("Script not found: %s", scriptName), http.StatusNotFound)
+			return
+		}
+		scriptPaths = append(scriptPaths, scriptPath)
+	}
+
+	// Stop any currently running script
+	l.runner.StopScript()
+
+	interval := time.Duration(req.Interval) * time.Millisecond
+	if err := l.runner.RunPlaylist(scriptPaths, interval, req.Loops); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to run playlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Return success response
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Playlist %s started (interval: %dms, loops: %d)\n", strings.Join(req.Scripts, ", "), req.Interval, req.Loops)
+}
+
+// handleLampProperties returns lamp properties as JSON, either the ones
+// listed in the names query parameter or the common state set
+func handleLampProperties(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	var properties map[string]string
+	var err error
+
+	if namesStr := r.URL.Query().Get("names"); namesStr != "" {
+		var names []string
+		for _, name := range strings.Split(namesStr, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			http.Error(w, "No property names given", http.StatusBadRequest)
+			return
+		}
+		properties, err = l.yeelight.GetPropertiesMap(names)
+	} else {
+		properties, err = l.yeelight.GetState()
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, yeelight.ErrTimeout):
+			status = http.StatusGatewayTimeout
+		case errors.Is(err, yeelight.ErrInvalidResponse):
+			status = http.StatusBadGateway
+		}
+		http.Error(w, fmt.Sprintf("Failed to read properties: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(properties)
+}
+
+// rawRequest is the body of a raw command request
+type rawRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// handleLampRaw sends an unvalidated command to the lamp and returns its
+// response as JSON
+func handleLampRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	var req rawRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid command: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Method == "" {
+		http.Error(w, "Command must have a method", http.StatusBadRequest)
+		return
+	}
+
+	response, err := l.yeelight.SendRaw(req.Method, req.Params...)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, yeelight.ErrTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, fmt.Sprintf("Failed to send command: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleLampSnapshot saves the current lamp state under the name in the URL
+func handleLampSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/lamp/snapshot/")
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "Invalid snapshot name", http.StatusBadRequest)
+		return
+	}
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := l.yeelight.SaveSnapshot(name); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, yeelight.ErrTimeout):
+			status = http.StatusGatewayTimeout
+		case errors.Is(err, yeelight.ErrInvalidResponse):
+			status = http.StatusBadGateway
+		}
+		http.Error(w, fmt.Sprintf("Failed to save snapshot: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Snapshot %s saved\n", name)
+}
+
+// handleLampRestore reapplies the lamp state saved under the name in the URL
+func handleLampRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/lamp/restore/")
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "Invalid snapshot name", http.StatusBadRequest)
+		return
+	}
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	// A running script would paint over the restored state
+	l.runner.StopScript()
+
+	if err := l.yeelight.RestoreSnapshot(name); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, yeelight.ErrNoSnapshot):
+			status = http.StatusNotFound
+		case errors.Is(err, yeelight.ErrTimeout):
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, fmt.Sprintf("Failed to restore snapshot: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Snapshot %s restored\n", name)
+}
+
+// handleStatusEffects returns the lamp's active effects and the runner
+// state as JSON
+func handleStatusEffects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := l.runner.GetActiveEffects()
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, yeelight.ErrTimeout):
+			code = http.StatusGatewayTimeout
+		case errors.Is(err, yeelight.ErrInvalidResponse):
+			code = http.StatusBadGateway
+		}
+		http.Error(w, fmt.Sprintf("Failed to read effects: %v", err), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleRunnerStatus reports what the runner is playing as JSON. It doesn't
+// talk to the lamp, so it is cheap enough to poll.
+func handleRunnerStatus(w http.ResponseWriter, r *http.Request, runner *yeelight.ScriptRunner) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := runner.Status()
+	// Report scripts by the name used in the URL, not their file path
+	status.Script = strings.TrimSuffix(filepath.Base(status.Script), ".txt")
+	if !status.Running {
+		status.Script = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// streamCommandInterval is the minimum time between matrix updates sent
+// from a stream, keeping the lamp within its command quota
+const streamCommandInterval = time.Second
+
+// handleLampStream accepts a WebSocket where each message is a JSON array
+// of 25 hex colors, and pushes every received frame to the lamp
+func handleLampStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l, ok := requestLamp(w, r)
+	if !ok {
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("WebSocket upgrade failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer ws.Close()
+
+	// The stream takes over the lamp from any running script
+	l.runner.StopScript()
+
+	if err := l.yeelight.SetOn(yeelight.DefaultOptions); err != nil {
+		ws.WriteText(fmt.Sprintf("Failed to turn on lamp: %v", err))
+		return
+	}
+	if err := l.yeelight.SetDirectMode(); err != nil {
+		ws.WriteText(fmt.Sprintf("Failed to set direct mode: %v", err))
+		return
+	}
+
+	// Frames arriving faster than the lamp accepts them are coalesced in a
+	// single slot buffer, only the latest one is sent
+	latest := make(chan yeelight.ColorMatrix, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go sendStreamFrames(ws, l.yeelight, latest, done)
+
+	for {
+		message, err := ws.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Stream closed: %v", err)
+			}
+			return
+		}
+
+		matrix, err := parseStreamFrame(message)
+		if err != nil {
+			ws.WriteText(err.Error())
+			continue
+		}
+
+		// Replace a frame that hasn't been sent yet
+		select {
+		case <-latest:
+		default:
+		}
+		latest <- matrix
+	}
+}
+
+// sendStreamFrames pushes frames from the latest buffer to the lamp, at most
+// one per streamCommandInterval, until done is closed
+func sendStreamFrames(ws *wsConn, yl *yeelight.Yeelight, latest chan yeelight.ColorMatrix, done chan struct{}) {
+	var lastSent time.Time
+	for {
+		var matrix yeelight.ColorMatrix
+		select {
+		case matrix = <-latest:
+		case <-done:
+			return
+		}
+
+		// Respect the lamp's command rate
+		if wait := streamCommandInterval - time.Since(lastSent); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return
+			}
+		}
+
+		// A newer frame may have arrived while waiting
+		select {
+		case matrix = <-latest:
+		default:
+		}
+
+		if err := yl.SetMatrix([]yeelight.ColorMatrix{matrix}); err != nil {
+			ws.WriteText(fmt.Sprintf("Failed to set matrix: %v", err))
+		}
+		lastSent = time.Now()
+	}
+}
+
+// parseStreamFrame decodes a JSON array of hex colors, one per LED, into a
+// matrix
+func parseStreamFrame(message []byte) (yeelight.ColorMatrix, error) {
+	var colors []string
+	if err := json.Unmarshal(message, &colors); err != nil {
+		return yeelight.ColorMatrix{}, fmt.Errorf("Invalid frame: %v", err)
+	}
+
+	if len(colors) != geometry.LEDs() {
+		return yeelight.ColorMatrix{}, fmt.Errorf("Invalid frame: expected %d colors, got %d", geometry.LEDs(), len(colors))
+	}
+
+	for _, hex := range colors {
+		var color yeelight.Color
+		if err := color.Hex(hex); err != nil {
+			return yeelight.ColorMatrix{}, fmt.Errorf("Invalid color: %s", hex)
+		}
+	}
+
+	return yeelight.MakeFromHexColors(colors), nil
+}
+
+// checkScriptLibraries stops the server from starting with a scripts
+// directory that is missing or unreadable
+func checkScriptLibraries() {
+	for _, dir := range scriptLibraries {
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			log.Fatalf("Scripts directory %s does not exist, set YEELIGHT_SCRIPTS to the folder containing your scripts", dir)
+		}
+		if err != nil {
+			log.Fatalf("Scripts directory %s is not readable: %v", dir, err)
+		}
+		if !info.IsDir() {
+			log.Fatalf("Scripts directory %s is not a directory, set YEELIGHT_SCRIPTS to the folder containing your scripts", dir)
+		}
+		if _, err := ioutil.ReadDir(dir); err != nil {
+			log.Fatalf("Scripts directory %s is not readable: %v", dir, err)
+		}
+	}
+}
+
+// scriptsDir returns the scripts directory selected by the library query
+// parameter (matched against the directory base name), defaulting to the
+// first configured library
+func scriptsDir(r *http.Request) (string, error) {
+	library := r.URL.Query().Get("library")
+	if library == "" {
+		return scriptsPath, nil
+	}
+
+	for _, dir := range scriptLibraries {
+		if filepath.Base(dir) == library {
+			return dir, nil
+		}
+	}
+
+	return "", fmt.Errorf("Library not found: %s", library)
+}
+
+// resolveScript builds the path of a script in the requested library,
+// rejecting names that would escape the library directory. On failure it
+// also returns the HTTP status to respond with.
+func resolveScript(r *http.Request, scriptName string) (string, int, error) {
+	dir, err := scriptsDir(r)
+	if err != nil {
+		return "", http.StatusNotFound, err
+	}
+
+	if scriptName == "" || filepath.Base(scriptName) != scriptName || strings.HasPrefix(scriptName, ".") {
+		return "", http.StatusBadRequest, fmt.Errorf("Invalid script name: %s", scriptName)
+	}
+
+	return filepath.Join(dir, scriptName+".txt"), http.StatusOK, nil
+}
+
+// defaultInterval returns the frame interval recommended by the script's
+// @interval header, falling back to yeelight.DefaultInterval
+func defaultInterval(scriptPath string) time.Duration {
+	if script, err := yeelight.ParseScriptGeometry(scriptPath, geometry); err == nil {
+		if interval, ok := script.Interval(); ok {
+			return interval
+		}
+	}
+	return yeelight.DefaultInterval
 }
 
-func handleStopScript(w http.ResponseWriter, r *http.Request, scriptName string) {
+func handleStopScript(w http.ResponseWriter, r *http.Request, runner *yeelight.ScriptRunner, scriptName string) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Stop the script
-	if err := globalRunner.StopScript(); err != nil {
+	if err := runner.StopScript(); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to stop script: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -224,38 +922,177 @@ func handleStopScript(w http.ResponseWriter, r *http.Request, scriptName string)
 	fmt.Fprintf(w, "Script %s stopped\n", scriptName)
 }
 
+func handleValidateScript(w http.ResponseWriter, r *http.Request, scriptName string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Build script path
+	scriptPath, status, err := resolveScript(r, scriptName)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Check if script exists
+	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Script not found: %s", scriptName), http.StatusNotFound)
+		return
+	}
+
+	script, err := yeelight.ParseScriptGeometry(scriptPath, geometry)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid script: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Return the frame count followed by any warnings
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Script %s is valid (%d frames)\n", scriptName, len(script.Frames))
+	for _, warning := range script.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+}
+
+func handleShowFrame(w http.ResponseWriter, r *http.Request, runner *yeelight.ScriptRunner, scriptName string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	frameIndex := 0
+	if nStr := r.URL.Query().Get("n"); nStr != "" {
+		val, err := strconv.Atoi(nStr)
+		if err != nil || val < 0 {
+			http.Error(w, fmt.Sprintf("Invalid frame number: %s", nStr), http.StatusBadRequest)
+			return
+		}
+		frameIndex = val
+	}
+
+	// Build script path
+	scriptPath, status, err := resolveScript(r, scriptName)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Check if script exists
+	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Script not found: %s", scriptName), http.StatusNotFound)
+		return
+	}
+
+	script, err := yeelight.ParseScriptGeometry(scriptPath, geometry)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse script: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if frameIndex >= len(script.Frames) {
+		http.Error(w, fmt.Sprintf("Frame %d out of range (script has %d frames)", frameIndex, len(script.Frames)), http.StatusBadRequest)
+		return
+	}
+
+	if err := runner.ShowFrame(script, frameIndex); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to show frame: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Optionally return the shown colors for a preview
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"script": scriptName,
+			"frame":  frameIndex,
+			"colors": script.Frames[frameIndex].ToHexSlice(),
+		})
+		return
+	}
+
+	// Return success response
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Script %s frame %d shown\n", scriptName, frameIndex)
+}
+
 func runCLIMode() {
 	args := flag.Args()
-	
+
 	// Check if script name is provided
 	if len(args) < 1 {
-		fmt.Println("Usage: go run main.go [options] <script_name> [interval_ms] [timeout_s]")
+		fmt.Println("Usage: go run main.go [options] <script_name> [interval_ms] [timeout_s] [forward|reverse|pingpong]")
+		fmt.Println("       go run main.go - [interval_ms] [timeout_s] [mode]  (read the script from stdin)")
+		fmt.Println("       go run main.go demo [interval_ms] [timeout_s]  (play the built-in demo)")
+		fmt.Println("       go run main.go name [new_name]")
 		fmt.Println("\nOptions:")
 		fmt.Println("  -http              Run in HTTP server mode")
+		fmt.Println("  -validate <script> Parse a script and print any warnings")
+		fmt.Println("  -benchmark <n>     Measure the round-trip time of n get_prop commands")
+		fmt.Println("  -discover          Search the LAN for lamps and print their addresses")
+		fmt.Println("  -dump-ascii <script> [frame]")
+		fmt.Println("                     Print the update_leds payload of a frame (default: 0)")
 		fmt.Println("\nEnvironment variables:")
-		fmt.Println("  YEELIGHT_ADDR    : Yeelight address (required)")
+		fmt.Println("  YEELIGHT_ADDR    : Yeelight address (required unless YEELIGHT_ADDRS is set)")
+		fmt.Println("  YEELIGHT_ADDRS   : Comma-separated list of additional Yeelight addresses")
 		fmt.Println("  YEELIGHT_HTTP    : HTTP server address (default: :3048)")
-		fmt.Println("  YEELIGHT_SCRIPTS     : Path to scripts folder (default: ./scripts)")
+		fmt.Println("  YEELIGHT_SCRIPTS     : Path to scripts folder, or colon-separated list of folders (default: ./scripts)")
 		fmt.Println("\nNote: If YEELIGHT_HTTP is set, the program will automatically start in HTTP mode")
 		return
 	}
 
+	if args[0] == "name" {
+		runNameCommand(args[1:])
+		return
+	}
+
 	// Build script filename
 	scriptName := args[0]
 	// Remove .txt extension if provided
 	scriptName = strings.TrimSuffix(scriptName, ".txt")
 	// Build full path
 	scriptPath := filepath.Join(scriptsPath, scriptName+".txt")
-	
-	// Default interval (milliseconds)
-	interval := 500 * time.Millisecond
+
+	// A script name of "-" reads the script from stdin
+	fromStdin := scriptName == "-"
+	var source []byte
+	if fromStdin {
+		scriptName = "stdin"
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Failed to read script from stdin: %v", err)
+		}
+		source = data
+	}
+
+	// An explicit interval always wins, 0 shows the first frame statically
+	interval := yeelight.IntervalFromScript
 	if len(args) > 1 {
 		ms, err := time.ParseDuration(args[1] + "ms")
-		if err == nil {
+		if err == nil && ms >= 0 {
 			interval = ms
 		}
 	}
 
+	// Default interval (from the script's @interval header, or 500ms)
+	if interval == yeelight.IntervalFromScript {
+		if scriptName == yeelight.DemoScriptName {
+			interval = yeelight.DemoInterval
+		} else if fromStdin {
+			interval = yeelight.DefaultInterval
+			if script, err := yeelight.ParseScriptReaderGeometry(scriptName, bytes.NewReader(source), geometry); err == nil {
+				if metaInterval, ok := script.Interval(); ok {
+					interval = metaInterval
+				}
+			}
+		} else {
+			interval = defaultInterval(scriptPath)
+		}
+	}
+
 	// Default timeout (0 = infinite)
 	var timeout time.Duration
 	if len(args) > 2 {
@@ -265,17 +1102,48 @@ func runCLIMode() {
 		}
 	}
 
+	// Frame order, forward by default
+	mode := yeelight.PlayForward
+	if len(args) > 3 {
+		m, err := yeelight.ParsePlayMode(args[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+		mode = m
+	}
+
 	// Run the script
-	fmt.Printf("Running script: %s (interval: %v, timeout: %v)\n", scriptName, interval, timeout)
-	if err := globalRunner.RunScript(scriptPath, interval, timeout); err != nil {
+	fmt.Printf("Running script: %s (interval: %v, timeout: %v, mode: %s)\n", scriptName, interval, timeout, mode)
+	var err error
+	if scriptName == yeelight.DemoScriptName {
+		err = globalRunner.RunDemo(interval, timeout)
+	} else if fromStdin {
+		var script *yeelight.Script
+		script, err = yeelight.ParseScriptReaderGeometry(scriptName, bytes.NewReader(source), geometry)
+		if err == nil {
+			script.PlayMode = mode
+			err = globalRunner.RunParsed(script, interval, timeout)
+		}
+	} else {
+		err = globalRunner.RunScriptWithMode(scriptPath, interval, timeout, mode)
+	}
+	if err != nil {
 		log.Fatalf("Failed to run script: %v", err)
 	}
 
 	// Wait for user to press enter to stop
 	if timeout == 0 {
-		fmt.Println("Press Enter to stop the script...")
-		fmt.Scanln()
-		
+		if fromStdin {
+			// stdin is taken by the script, so wait for Ctrl+C instead
+			fmt.Println("Press Ctrl+C to stop the script...")
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+			<-stop
+		} else {
+			fmt.Println("Press Enter to stop the script...")
+			fmt.Scanln()
+		}
+
 		// Stop the script
 		if err := globalRunner.StopScript(); err != nil {
 			log.Printf("Failed to stop script: %v", err)
@@ -286,4 +1154,128 @@ func runCLIMode() {
 	}
 
 	fmt.Println("Script finished.")
-}
\ No newline at end of file
+}
+
+// runNameCommand prints the lamp name, or sets it when a new one is given
+func runNameCommand(args []string) {
+	if len(args) == 0 {
+		name, err := globalYeelight.GetName()
+		if err != nil {
+			log.Fatalf("Failed to get name: %v", err)
+		}
+		fmt.Println(name)
+		return
+	}
+
+	name := strings.TrimSpace(strings.Join(args, " "))
+	if name == "" {
+		log.Fatal("Name must not be empty")
+	}
+
+	if err := globalYeelight.SetName(name); err != nil {
+		log.Fatalf("Failed to set name: %v", err)
+	}
+	fmt.Printf("Name set to: %s\n", name)
+}
+
+// runBenchmark sends n get_prop commands one after another and prints
+// min/avg/max/p99 round-trip times of the answered ones
+func runBenchmark(n int) {
+	// A retried command would hide the timeout in the measurement
+	globalYeelight.TimeoutRetries = -1
+
+	var rtts []time.Duration
+	var total time.Duration
+	timeouts := 0
+	failures := 0
+
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		_, err := globalYeelight.GetPropertiesMap([]string{"power"})
+		rtt := time.Since(start)
+
+		switch {
+		case errors.Is(err, yeelight.ErrTimeout):
+			timeouts++
+		case err != nil:
+			failures++
+			log.Printf("Command %d failed: %v", i+1, err)
+		default:
+			rtts = append(rtts, rtt)
+			total += rtt
+		}
+	}
+
+	fmt.Printf("Sent %d commands: %d answered, %d timed out, %d failed\n", n, len(rtts), timeouts, failures)
+	if len(rtts) == 0 {
+		return
+	}
+
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	p99 := rtts[(len(rtts)*99+99)/100-1]
+	fmt.Printf("min %v, avg %v, max %v, p99 %v\n", rtts[0], total/time.Duration(len(rtts)), rtts[len(rtts)-1], p99)
+}
+
+// discoverTimeout is how long -discover waits for lamps to answer
+const discoverTimeout = 3 * time.Second
+
+// runDiscover prints the lamps answering a discovery request as a table
+func runDiscover() {
+	devices, err := yeelight.Discover(discoverTimeout)
+	if err != nil {
+		log.Printf("Discovery failed: %v", err)
+	}
+	if len(devices) == 0 {
+		fmt.Println("No lamps found. Check that LAN Control is enabled for them in the Yeelight app.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tID\tMODEL\tNAME")
+	for i := range devices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", devices[i].Address, devices[i].DeviceID, devices[i].Model, devices[i].Name)
+	}
+	w.Flush()
+}
+
+// runDumpASCII prints the update_leds payload of a single script frame
+func runDumpASCII(scriptName string, args []string) {
+	scriptName = strings.TrimSuffix(scriptName, ".txt")
+	scriptPath := filepath.Join(scriptsPath, scriptName+".txt")
+
+	frameIndex := 0
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			log.Fatalf("Invalid frame number: %s", args[0])
+		}
+		frameIndex = n
+	}
+
+	script, err := yeelight.ParseScriptGeometry(scriptPath, geometry)
+	if err != nil {
+		log.Fatalf("Failed to parse script: %v", err)
+	}
+
+	if frameIndex < 0 || frameIndex >= len(script.Frames) {
+		log.Fatalf("Frame %d out of range (script has %d frames)", frameIndex, len(script.Frames))
+	}
+
+	fmt.Println(script.Frames[frameIndex].ToASCII())
+}
+
+// runValidate parses a script and prints its frame count and warnings
+func runValidate(scriptName string) {
+	scriptName = strings.TrimSuffix(scriptName, ".txt")
+	scriptPath := filepath.Join(scriptsPath, scriptName+".txt")
+
+	script, err := yeelight.ParseScriptGeometry(scriptPath, geometry)
+	if err != nil {
+		log.Fatalf("Invalid script: %v", err)
+	}
+
+	fmt.Printf("Script %s is valid (%d frames)\n", scriptName, len(script.Frames))
+	for _, warning := range script.Warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+}
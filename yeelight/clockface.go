@@ -0,0 +1,113 @@
+package yeelight
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// ClockScriptName is the name of the built-in clock script played by
+// RunClock.
+const ClockScriptName = "clock"
+
+// Clock hands move clockwise around the center, starting at 12 o'clock
+var (
+	// outerRing holds the 16 border pixels, used by the minute hand
+	outerRing = []Vector{
+		{0, 2}, {0, 3}, {0, 4}, {1, 4}, {2, 4}, {3, 4}, {4, 4}, {4, 3},
+		{4, 2}, {4, 1}, {4, 0}, {3, 0}, {2, 0}, {1, 0}, {0, 0}, {0, 1},
+	}
+	// innerRing holds the 8 pixels around the center, used by the hour hand
+	innerRing = []Vector{
+		{1, 2}, {1, 3}, {2, 3}, {3, 3}, {3, 2}, {3, 1}, {2, 1}, {1, 1},
+	}
+)
+
+// RenderClock draws an analog clock face for t: the hour hand is a red
+// pixel on the ring around the white center, the minute hand a blue pixel
+// on the border.
+func RenderClock(t time.Time) ColorMatrix {
+	colorMatrix := MakeMatrix("#000000", 25)
+	colorMatrix.SetHex(Vector{2, 2}, "#FFFFFF")
+
+	hours := (float64(t.Hour()%12) + float64(t.Minute())/60) / 12
+	colorMatrix.SetHex(innerRing[ringPosition(hours, len(innerRing))], "#FF0000")
+
+	minutes := (float64(t.Minute()) + float64(t.Second())/60) / 60
+	colorMatrix.SetHex(outerRing[ringPosition(minutes, len(outerRing))], "#0000FF")
+
+	return colorMatrix
+}
+
+// ringPosition returns the ring pixel closest to a fraction of a full turn
+func ringPosition(fraction float64, size int) int {
+	return int(math.Round(fraction*float64(size))) % size
+}
+
+// clockRefresh is how often the clock face is recomputed. A frame is only
+// sent when the face changes, which happens every few minutes.
+const clockRefresh = time.Second
+
+// RunClock turns the lamp into a desk clock, showing RenderClock of the
+// current time until stopped or the timeout (0 = infinite) expires
+func (sr *ScriptRunner) RunClock(timeout time.Duration) error {
+	ctx, err := sr.reserve()
+	if err != nil {
+		return err
+	}
+
+	sr.mu.Lock()
+	sr.currentScript = &Script{Name: ClockScriptName}
+	sr.interval = clockRefresh
+	sr.mu.Unlock()
+
+	if err := sr.prepareLamp(ClockScriptName, true, ColorMatrix{}); err != nil {
+		sr.abortStart()
+		return err
+	}
+
+	sr.logger.Event("start", LogFields{"script": ClockScriptName, "timeout": timeout})
+
+	go sr.runClockLoop(ctx, timeout)
+
+	return nil
+}
+
+// runClockLoop redraws the clock face whenever it changes
+func (sr *ScriptRunner) runClockLoop(ctx context.Context, timeout time.Duration) {
+	defer func() {
+		sr.finish(recover())
+	}()
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = sr.clock.After(timeout)
+	}
+
+	// Turn off the lamp when the clock stops, see KeepLastFrame
+	defer sr.leaveLamp()
+
+	sr.resetDisplay()
+
+	ticker := sr.clock.NewTicker(clockRefresh)
+	defer ticker.Stop()
+
+	shown := ""
+	for {
+		frame := RenderClock(sr.clock.Now())
+		if ascii := frame.ToASCII(); ascii != shown {
+			sr.display(&Script{Name: ClockScriptName, Frames: []ColorMatrix{frame}, DirectMode: true}, 0)
+			shown = ascii
+		}
+
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			sr.logger.Event("stop", LogFields{"script": ClockScriptName})
+			return
+		case <-timeoutChan:
+			sr.logger.Event("timeout", LogFields{"script": ClockScriptName})
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package yeelight
+
+import "time"
+
+// DemoScriptName is the name of the built-in demo script played by RunDemo.
+const DemoScriptName = "demo"
+
+// DemoInterval is the frame interval of the demo when none is given
+const DemoInterval = 300 * time.Millisecond
+
+// DemoScript returns a short built-in animation exercising fills, single
+// pixels, circles, scrolling text and a rainbow, to check that a lamp
+// works without writing a script.
+func DemoScript() *Script {
+	script := &Script{
+		Name:        DemoScriptName,
+		Meta:        map[string]string{},
+		Backgrounds: map[int]string{},
+		DirectMode:  true,
+	}
+
+	// Solid fills
+	for _, color := range []string{"#FF0000", "#00FF00", "#0000FF"} {
+		script.Frames = append(script.Frames, MakeMatrix(color, 25))
+	}
+
+	// A pixel walking along the middle row
+	for column := 0; column < 5; column++ {
+		frame := MakeMatrix("#000000", 25)
+		frame.SetHex(Vector{Row: 2, Column: column}, "#FFFFFF")
+		script.Frames = append(script.Frames, frame)
+	}
+
+	// Growing circles
+	for radius := 0; radius <= 2; radius++ {
+		frame := MakeMatrix("#000000", 25)
+		drawCircle(&frame, 2, 2, radius, "#00FFFF")
+		script.Frames = append(script.Frames, frame)
+	}
+
+	// "HI" scrolling from right to left
+	script.Frames = append(script.Frames, textFrames(MakeMatrix("#000000", 25), "HI", "#FFA500", ' ')...)
+
+	// Rainbow cycling along the diagonal
+	for step := 0; step < 12; step++ {
+		frame := MakeMatrix("#000000", 25)
+		frame.ApplyFunc(func(v Vector, c Color) Color {
+			return MakeColorHSV(float64((v.Row+v.Column)*36+step*30), 1, 1)
+		})
+		script.Frames = append(script.Frames, frame)
+	}
+
+	return script
+}
+
+// RunDemo plays DemoScript with the given interval (0 uses 300ms) and
+// timeout, see RunScript
+func (sr *ScriptRunner) RunDemo(interval, timeout time.Duration) error {
+	if interval == 0 {
+		interval = DemoInterval
+	}
+	return sr.RunParsed(DemoScript(), interval, timeout)
+}
@@ -0,0 +1,97 @@
+package yeelight
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ssdpAddress is the multicast group lamps listen on for discovery
+const ssdpAddress = "239.255.255.250:1982"
+
+// ssdpSearch is the search request answered by every lamp with LAN Control
+// enabled
+const ssdpSearch = "M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1982\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"ST: wifi_bulb\r\n" +
+	"\r\n"
+
+// Discover searches the LAN for lamps with an SSDP request and collects the
+// answers until timeout. Each lamp is returned once, with Address, DeviceID,
+// Model, Name and Support filled in from its answer. Lamps answering after
+// the timeout are missed; the ones found so far are returned even when
+// reading fails.
+func Discover(timeout time.Duration) ([]Yeelight, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open discovery socket: %w", err)
+	}
+	defer conn.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo([]byte(ssdpSearch), group); err != nil {
+		return nil, fmt.Errorf("failed to send discovery request: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var devices []Yeelight
+	seen := map[string]bool{}
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return devices, nil
+			}
+			return devices, err
+		}
+
+		header, err := parseDiscoveryResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		address := strings.TrimPrefix(header.Get("Location"), "yeelight://")
+		id := header.Get("id")
+		if address == "" || id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		devices = append(devices, Yeelight{
+			Address:  address,
+			DeviceID: id,
+			Model:    header.Get("model"),
+			Name:     header.Get("name"),
+			Support:  strings.Fields(header.Get("support")),
+		})
+	}
+}
+
+// parseDiscoveryResponse parses the HTTP style headers of a lamp's answer
+// to the search request
+func parseDiscoveryResponse(data []byte) (http.Header, error) {
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected discovery status: %s", response.Status)
+	}
+	return response.Header, nil
+}
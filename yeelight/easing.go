@@ -0,0 +1,59 @@
+package yeelight
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Easing shapes the progress of a transition over time
+type Easing int
+
+const (
+	Linear    Easing = iota // Constant speed
+	EaseIn                  // Starts slow, ends fast (cubic)
+	EaseOut                 // Starts fast, ends slow (cubic)
+	EaseInOut               // Slow at both ends (cubic)
+)
+
+// Apply maps the linear progress t (0.0-1.0) to the eased progress
+func (e Easing) Apply(t float64) float64 {
+	if t <= 0 {
+		return 0
+	}
+	if t >= 1 {
+		return 1
+	}
+
+	switch e {
+	case EaseIn:
+		return t * t * t
+	case EaseOut:
+		u := 1 - t
+		return 1 - u*u*u
+	case EaseInOut:
+		if t < 0.5 {
+			return 4 * t * t * t
+		}
+		u := -2*t + 2
+		return 1 - u*u*u/2
+	default:
+		return t
+	}
+}
+
+// ParseEasing returns the easing with the given name: linear, easein,
+// easeout or easeinout
+func ParseEasing(name string) (Easing, error) {
+	switch strings.ToLower(name) {
+	case "linear":
+		return Linear, nil
+	case "easein":
+		return EaseIn, nil
+	case "easeout":
+		return EaseOut, nil
+	case "easeinout":
+		return EaseInOut, nil
+	default:
+		return Linear, fmt.Errorf("unknown easing: %s", name)
+	}
+}
@@ -0,0 +1,64 @@
+package yeelight
+
+import "strconv"
+
+// EffectsStatus summarizes everything that currently changes the lamp on
+// its own: a color flow, music mode, a delay-off timer and the runner.
+type EffectsStatus struct {
+	Flowing bool `json:"flowing"`
+	// Flow is the running color flow, when the lamp reports flow_params
+	// in a form ParseFlowExpression understands
+	Flow      []FlowState `json:"flow,omitempty"`
+	MusicMode bool        `json:"music_mode"`
+	// MusicConnection is the state of this client's music mode connection,
+	// see Yeelight.MusicModeState
+	MusicConnection string `json:"music_connection"`
+	// DelayOff is the number of minutes before the lamp turns off, 0 when
+	// no timer is set
+	DelayOff int `json:"delay_off"`
+	// ScriptRunning is set while this runner plays a script or playlist,
+	// Script is the name of the current one
+	ScriptRunning bool   `json:"script_running"`
+	Script        string `json:"script,omitempty"`
+	// Frame is the last frame displayed by the runner as hex colors, row
+	// by row
+	Frame []string `json:"frame,omitempty"`
+}
+
+// GetActiveEffects reads the lamp's effect properties in a single get_prop
+// command and combines them with the runner's own state.
+func (sr *ScriptRunner) GetActiveEffects() (EffectsStatus, error) {
+	properties, err := sr.yeelight.GetPropertiesMap([]string{"flowing", "flow_params", "music_on", "delayoff"})
+	if err != nil {
+		return EffectsStatus{}, err
+	}
+
+	status := EffectsStatus{
+		Flowing:   properties["flowing"] == "1",
+		MusicMode: properties["music_on"] == "1",
+
+		MusicConnection: sr.yeelight.MusicModeState(),
+	}
+	if status.Flowing && properties["flow_params"] != "" {
+		if flow, err := ParseFlowExpression(properties["flow_params"]); err == nil {
+			status.Flow = flow
+		}
+	}
+	// Unsupported properties are empty and leave the timer at 0
+	if delay, err := strconv.Atoi(properties["delayoff"]); err == nil {
+		status.DelayOff = delay
+	}
+
+	sr.mu.Lock()
+	status.ScriptRunning = sr.isRunning
+	if sr.isRunning && sr.currentScript != nil {
+		status.Script = sr.currentScript.Name
+	}
+	sr.mu.Unlock()
+
+	if frame, ok := sr.LastFrame(); ok {
+		status.Frame = frame.ToHexSlice()
+	}
+
+	return status, nil
+}
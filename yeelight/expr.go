@@ -0,0 +1,317 @@
+package yeelight
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprNode is a node of a parsed EXPR arithmetic expression
+type exprNode interface {
+	eval(vars map[string]float64) float64
+}
+
+type exprNumber float64
+
+type exprVar string
+
+type exprUnary struct {
+	x exprNode
+}
+
+type exprBinary struct {
+	op   byte
+	l, r exprNode
+}
+
+type exprCall struct {
+	fn   string
+	args []exprNode
+}
+
+// exprFuncs maps the functions available in expressions to their arity
+var exprFuncs = map[string]int{
+	"sin": 1,
+	"cos": 1,
+	"abs": 1,
+	"mod": 2,
+}
+
+func (n exprNumber) eval(vars map[string]float64) float64 {
+	return float64(n)
+}
+
+func (n exprVar) eval(vars map[string]float64) float64 {
+	return vars[string(n)]
+}
+
+func (n exprUnary) eval(vars map[string]float64) float64 {
+	return -n.x.eval(vars)
+}
+
+func (n exprBinary) eval(vars map[string]float64) float64 {
+	l, r := n.l.eval(vars), n.r.eval(vars)
+	switch n.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	case '/':
+		if r == 0 {
+			return 0
+		}
+		return l / r
+	default:
+		return floorMod(l, r)
+	}
+}
+
+func (n exprCall) eval(vars map[string]float64) float64 {
+	switch n.fn {
+	case "sin":
+		return math.Sin(n.args[0].eval(vars))
+	case "cos":
+		return math.Cos(n.args[0].eval(vars))
+	case "abs":
+		return math.Abs(n.args[0].eval(vars))
+	default:
+		return floorMod(n.args[0].eval(vars), n.args[1].eval(vars))
+	}
+}
+
+// floorMod returns the modulo with the sign of the divisor, so that
+// negative values wrap around like hues do. Division by zero yields 0.
+func floorMod(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a - b*math.Floor(a/b)
+}
+
+// exprParser is a recursive descent parser for arithmetic expressions with
+// + - * / %, parentheses, numbers, variables and a few functions
+type exprParser struct {
+	tokens []string
+	pos    int
+	vars   map[string]bool
+}
+
+// parseExpr parses an expression that may reference the given variables
+func parseExpr(src string, vars ...string) (exprNode, error) {
+	tokens, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens, vars: map[string]bool{}}
+	for _, v := range vars {
+		p.vars[v] = true
+	}
+
+	node, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.tokens[p.pos])
+	}
+
+	return node, nil
+}
+
+func tokenizeExpr(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*/%(),", c):
+			tokens = append(tokens, string(c))
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		case unicode.IsLetter(c):
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, strings.ToLower(src[i:j]))
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q in expression", c)
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	return tokens, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(token string) error {
+	if p.peek() != token {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected %q at end of expression", token)
+		}
+		return fmt.Errorf("expected %q, got %q", token, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, l: left, r: right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "*" || p.peek() == "/" || p.peek() == "%" {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, l: left, r: right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == "-" {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{x: x}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	switch {
+	case token == "(":
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in expression", token)
+		}
+		return exprNumber(value), nil
+
+	case unicode.IsLetter(rune(token[0])):
+		if arity, ok := exprFuncs[token]; ok {
+			return p.parseCall(token, arity)
+		}
+		if p.vars[token] {
+			return exprVar(token), nil
+		}
+		return nil, fmt.Errorf("unknown variable %q in expression", token)
+
+	default:
+		return nil, fmt.Errorf("unexpected %q in expression", token)
+	}
+}
+
+func (p *exprParser) parseCall(fn string, arity int) (exprNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	call := exprCall{fn: fn}
+	for i := 0; i < arity; i++ {
+		if i > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return call, nil
+}
+
+// drawExpr evaluates the expression for every pixel with x, y and the frame
+// variable set. For "hue" the pixel becomes the fully saturated hue in
+// degrees, for "bright" the pixel's color is scaled by the value (0.0-1.0).
+func drawExpr(matrix *ColorMatrix, target string, expr exprNode, frameVar string, frame int) {
+	vars := map[string]float64{frameVar: float64(frame)}
+	matrix.ApplyFunc(func(v Vector, c Color) Color {
+		vars["x"] = float64(v.Column)
+		vars["y"] = float64(v.Row)
+		value := expr.eval(vars)
+
+		if target == "hue" {
+			return MakeColorHSV(floorMod(value, 360), 1, 1)
+		}
+
+		factor := math.Max(0, math.Min(1, value))
+		r, g, b := c.ToRGB()
+		r = byte(float64(r) * factor)
+		g = byte(float64(g) * factor)
+		b = byte(float64(b) * factor)
+		return Color{Value: int64(r)<<16 | int64(g)<<8 | int64(b)}
+	})
+}
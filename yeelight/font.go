@@ -0,0 +1,172 @@
+package yeelight
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// digitFont is a compact 3x5 bitmap font for the digits 0-9. Each row is 3
+// characters wide, 'X' marks a lit pixel.
+var digitFont = map[rune][5]string{
+	'0': {"XXX", "X.X", "X.X", "X.X", "XXX"},
+	'1': {".X.", "XX.", ".X.", ".X.", "XXX"},
+	'2': {"XXX", "..X", "XXX", "X..", "XXX"},
+	'3': {"XXX", "..X", ".XX", "..X", "XXX"},
+	'4': {"X.X", "X.X", "XXX", "..X", "..X"},
+	'5': {"XXX", "X..", "XXX", "..X", "XXX"},
+	'6': {"XXX", "X..", "XXX", "X.X", "XXX"},
+	'7': {"XXX", "..X", ".X.", ".X.", ".X."},
+	'8': {"XXX", "X.X", "XXX", "X.X", "XXX"},
+	'9': {"XXX", "X.X", "XXX", "..X", "XXX"},
+}
+
+// narrowDigitFont is a 2x5 font used for the tens digit of two-digit
+// numbers, so that both digits fit side by side on the 5 column grid
+var narrowDigitFont = map[rune][5]string{
+	'1': {".X", "XX", ".X", ".X", ".X"},
+	'2': {"XX", ".X", "XX", "X.", "XX"},
+	'3': {"XX", ".X", "XX", ".X", "XX"},
+	'4': {"X.", "X.", "XX", ".X", ".X"},
+	'5': {"XX", "X.", "XX", ".X", "XX"},
+	'6': {"X.", "X.", "XX", "XX", "XX"},
+	'7': {"XX", ".X", ".X", ".X", ".X"},
+	'8': {"XX", "XX", "..", "XX", "XX"},
+	'9': {"XX", "XX", "XX", ".X", ".X"},
+}
+
+// drawGlyph draws the lit pixels of a glyph with its top left corner at
+// column x, clipping pixels outside the matrix
+func drawGlyph(matrix *ColorMatrix, glyph [5]string, x int, color string) {
+	for y, row := range glyph {
+		for dx, pixel := range row {
+			v := Vector{Row: y, Column: x + dx}
+			if pixel == 'X' && matrix.contains(v) {
+				matrix.SetHex(v, color)
+			}
+		}
+	}
+}
+
+// drawNumber draws a number from 0 to 99. Single digits are centered,
+// two-digit numbers use a narrow tens digit next to a regular units digit.
+func drawNumber(matrix *ColorMatrix, n int, color string) error {
+	if n < 0 || n > 99 {
+		return fmt.Errorf("invalid number: %d (must be 0-99)", n)
+	}
+
+	if n < 10 {
+		drawGlyph(matrix, digitFont[rune('0'+n)], 1, color)
+		return nil
+	}
+
+	drawGlyph(matrix, narrowDigitFont[rune('0'+n/10)], 0, color)
+	drawGlyph(matrix, digitFont[rune('0'+n%10)], 2, color)
+	return nil
+}
+
+// letterFont is a 3x5 bitmap font for the letters A-Z and a few punctuation
+// marks, matching digitFont
+var letterFont = map[rune][5]string{
+	'A': {".X.", "X.X", "XXX", "X.X", "X.X"},
+	'B': {"XX.", "X.X", "XX.", "X.X", "XX."},
+	'C': {".XX", "X..", "X..", "X..", ".XX"},
+	'D': {"XX.", "X.X", "X.X", "X.X", "XX."},
+	'E': {"XXX", "X..", "XX.", "X..", "XXX"},
+	'F': {"XXX", "X..", "XX.", "X..", "X.."},
+	'G': {".XX", "X..", "X.X", "X.X", ".XX"},
+	'H': {"X.X", "X.X", "XXX", "X.X", "X.X"},
+	'I': {"XXX", ".X.", ".X.", ".X.", "XXX"},
+	'J': {"..X", "..X", "..X", "X.X", ".X."},
+	'K': {"X.X", "X.X", "XX.", "X.X", "X.X"},
+	'L': {"X..", "X..", "X..", "X..", "XXX"},
+	'M': {"X.X", "XXX", "XXX", "X.X", "X.X"},
+	'N': {"XX.", "X.X", "X.X", "X.X", "X.X"},
+	'O': {".X.", "X.X", "X.X", "X.X", ".X."},
+	'P': {"XX.", "X.X", "XX.", "X..", "X.."},
+	'Q': {".X.", "X.X", "X.X", "XX.", ".XX"},
+	'R': {"XX.", "X.X", "XX.", "X.X", "X.X"},
+	'S': {".XX", "X..", ".X.", "..X", "XX."},
+	'T': {"XXX", ".X.", ".X.", ".X.", ".X."},
+	'U': {"X.X", "X.X", "X.X", "X.X", "XXX"},
+	'V': {"X.X", "X.X", "X.X", "X.X", ".X."},
+	'W': {"X.X", "X.X", "XXX", "XXX", "X.X"},
+	'X': {"X.X", "X.X", ".X.", "X.X", "X.X"},
+	'Y': {"X.X", "X.X", ".X.", ".X.", ".X."},
+	'Z': {"XXX", "..X", ".X.", "X..", "XXX"},
+	' ': {"...", "...", "...", "...", "..."},
+	'!': {".X.", ".X.", ".X.", "...", ".X."},
+	'?': {"XX.", "..X", ".X.", "...", ".X."},
+	'-': {"...", "...", "XXX", "...", "..."},
+	'.': {"...", "...", "...", "...", ".X."},
+	':': {"...", ".X.", "...", ".X.", "..."},
+}
+
+// textGlyph returns the glyph of a character, letters in either case
+func textGlyph(r rune) ([5]string, bool) {
+	if glyph, ok := digitFont[r]; ok {
+		return glyph, true
+	}
+	glyph, ok := letterFont[unicode.ToUpper(r)]
+	return glyph, ok
+}
+
+// textWidth is the number of columns taken by text drawn with drawText
+func textWidth(text string) int {
+	n := utf8.RuneCountInString(text)
+	if n == 0 {
+		return 0
+	}
+	return n*4 - 1
+}
+
+// drawText draws text with its left edge at column x, leaving one column
+// between glyphs. Characters missing from the font are drawn as fallback,
+// or left blank when fallback has no glyph either.
+func drawText(matrix *ColorMatrix, text string, x int, color string, fallback rune) {
+	for i, r := range []rune(text) {
+		glyph, ok := textGlyph(r)
+		if !ok {
+			glyph, ok = textGlyph(fallback)
+		}
+		if ok {
+			drawGlyph(matrix, glyph, x+i*4, color)
+		}
+	}
+}
+
+// textFrameCount is the number of frames text takes on a matrix with the
+// given number of columns, see textFrames
+func textFrameCount(text string, columns int) int {
+	width := textWidth(text)
+	if width <= columns {
+		return 1
+	}
+	return columns + width
+}
+
+// textFrame returns frame step of text drawn over background, see
+// textFrames
+func textFrame(background ColorMatrix, text, color string, fallback rune, step int) ColorMatrix {
+	width, columns := textWidth(text), background.width()
+	frame := background.Flatten()
+	if width <= columns {
+		drawText(&frame, text, (columns-width)/2, color, fallback)
+	} else {
+		drawText(&frame, text, columns-step, color, fallback)
+	}
+	return frame
+}
+
+// textFrames draws text over background. Text that fits the matrix, such
+// as a single character, is centered on one frame; longer text scrolls in
+// from the right edge until its last column leaves on the left, one frame
+// per column.
+func textFrames(background ColorMatrix, text, color string, fallback rune) []ColorMatrix {
+	count := textFrameCount(text, background.width())
+	frames := make([]ColorMatrix, 0, count)
+	for step := 0; step < count; step++ {
+		frames = append(frames, textFrame(background, text, color, fallback, step))
+	}
+	return frames
+}
@@ -0,0 +1,87 @@
+package yeelight
+
+import (
+	"slices"
+	"testing"
+)
+
+// litColumns returns the columns of a row that aren't black
+func litColumns(matrix ColorMatrix, row int) []int {
+	var columns []int
+	for column := 0; column < matrix.width(); column++ {
+		if pixel(matrix, column, row) != "#000000" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+func TestTextLetterIsCentered(t *testing.T) {
+	script := mustParse(t, "TEXT \"I\" white\n")
+	if len(script.Frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(script.Frames))
+	}
+
+	// The 3 column wide glyph starts at column 1, its stem is the center
+	// column
+	want := [][]int{{1, 2, 3}, {2}, {2}, {2}, {1, 2, 3}}
+	frame := script.Frames[0]
+	for row, columns := range want {
+		if got := litColumns(frame, row); !slices.Equal(got, columns) {
+			t.Errorf("row %d: lit columns %v, want %v", row, got, columns)
+		}
+	}
+	if got := pixel(frame, 2, 2); got != "#ffffff" {
+		t.Errorf("center pixel is %s, want #ffffff", got)
+	}
+}
+
+func TestTextScrollsOneFramePerColumn(t *testing.T) {
+	script := mustParse(t, "TEXT \"HI\" red\n")
+
+	// 5 columns plus the 7 columns of the text
+	if len(script.Frames) != 12 {
+		t.Fatalf("got %d frames, want 12", len(script.Frames))
+	}
+
+	// The text starts just beyond the right edge
+	for row := 0; row < 5; row++ {
+		if got := litColumns(script.Frames[0], row); len(got) != 0 {
+			t.Errorf("first frame row %d: lit columns %v, want none", row, got)
+		}
+	}
+
+	// The second frame shows the left column of H on the right edge
+	for row := 0; row < 5; row++ {
+		if got := litColumns(script.Frames[1], row); !slices.Equal(got, []int{4}) {
+			t.Errorf("second frame row %d: lit columns %v, want [4]", row, got)
+		}
+	}
+
+	// The last frame shows the right column of I on the left edge
+	want := [][]int{{0}, nil, nil, nil, {0}}
+	for row, columns := range want {
+		if got := litColumns(script.Frames[11], row); !slices.Equal(got, columns) {
+			t.Errorf("last frame row %d: lit columns %v, want %v", row, got, columns)
+		}
+	}
+}
+
+func TestTextFallback(t *testing.T) {
+	withFallback := mustParse(t, "TEXT \"#\" red ?\n").Frames[0]
+	question := mustParse(t, "TEXT \"?\" red\n").Frames[0]
+	if !slices.Equal(withFallback.ToHexSlice(), question.ToHexSlice()) {
+		t.Errorf("unknown character wasn't drawn as the fallback")
+	}
+
+	blank := mustParse(t, "TEXT \"#\" red\n").Frames[0]
+	for row := 0; row < 5; row++ {
+		if got := litColumns(blank, row); len(got) != 0 {
+			t.Errorf("row %d: lit columns %v, want none", row, got)
+		}
+	}
+
+	if got := parseError(t, "TEXT \"A\" red #\n"); got != "line 1: invalid fallback character: #" {
+		t.Errorf("got %q", got)
+	}
+}
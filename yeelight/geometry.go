@@ -0,0 +1,165 @@
+package yeelight
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Geometry is the layout of the LEDs driven by update_leds, which are
+// addressed row by row. The Cube's matrix module is 5x5; a strip of 25 LEDs
+// is 1x25.
+type Geometry struct {
+	Rows int
+	Cols int
+}
+
+// DefaultGeometry is the 5x5 matrix of a single Cube module.
+var DefaultGeometry = Geometry{Rows: 5, Cols: 5}
+
+// ParseGeometry parses a geometry written as rows x columns, e.g. "5x5" or
+// "1x25".
+func ParseGeometry(s string) (Geometry, error) {
+	rows, cols, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "x")
+	if !ok {
+		return Geometry{}, fmt.Errorf("invalid geometry: %s (expected rows x columns, e.g. 5x5)", s)
+	}
+
+	g := Geometry{}
+	var err error
+	if g.Rows, err = strconv.Atoi(rows); err != nil || g.Rows < 1 {
+		return Geometry{}, fmt.Errorf("invalid geometry: %s (rows must be a positive number)", s)
+	}
+	if g.Cols, err = strconv.Atoi(cols); err != nil || g.Cols < 1 {
+		return Geometry{}, fmt.Errorf("invalid geometry: %s (columns must be a positive number)", s)
+	}
+	return g, nil
+}
+
+func (g Geometry) String() string {
+	return fmt.Sprintf("%dx%d", g.Rows, g.Cols)
+}
+
+// LEDs returns the number of LEDs, Rows times Cols.
+func (g Geometry) LEDs() int {
+	return g.Rows * g.Cols
+}
+
+// MakeMatrix returns a matrix of the geometry filled with one color.
+func (g Geometry) MakeMatrix(hex string) ColorMatrix {
+	matrix := MakeMatrix(hex, g.LEDs())
+	matrix.Width = g.Cols
+	return matrix
+}
+
+// Index returns the position of the LED at v in the update_leds order.
+func (g Geometry) Index(v Vector) int {
+	return v.Row*g.Cols + v.Column
+}
+
+// MakeSpotMatrix returns a black matrix of the geometry with the top left
+// LED set to hex.
+func (g Geometry) MakeSpotMatrix(hex string) ColorMatrix {
+	matrix := g.MakeMatrix("#000000")
+	matrix.SetHex(Vector{0, 0}, hex)
+	return matrix
+}
+
+// MatrixFromArt builds a matrix from one line of runes per row, every rune
+// mapped to a color by the palette, e.g. '.' to "black" and 'R' to
+// "#FF0000". Palette colors use the script notation, hex or named.
+// Surrounding blank lines and indentation are ignored, so the art can be
+// written as an indented raw string literal.
+func (g Geometry) MatrixFromArt(art string, palette map[rune]string) (ColorMatrix, error) {
+	lines := strings.Split(strings.TrimSpace(art), "\n")
+	if len(lines) != g.Rows {
+		return ColorMatrix{}, fmt.Errorf("art has %d lines, expected %d", len(lines), g.Rows)
+	}
+
+	matrix := g.MakeMatrix("#000000")
+	for row, line := range lines {
+		runes := []rune(strings.TrimSpace(line))
+		if len(runes) != g.Cols {
+			return ColorMatrix{}, fmt.Errorf("art line %d has %d runes, expected %d", row+1, len(runes), g.Cols)
+		}
+		for column, r := range runes {
+			name, ok := palette[r]
+			if !ok {
+				return ColorMatrix{}, fmt.Errorf("art line %d: rune %q is not in the palette", row+1, r)
+			}
+			hex, err := parseColor(name)
+			if err != nil {
+				return ColorMatrix{}, fmt.Errorf("palette color for %q: %w", r, err)
+			}
+			matrix.SetHex(Vector{Row: row, Column: column}, hex)
+		}
+	}
+
+	return matrix, nil
+}
+
+// RenderBars renders values in range 0-1 as vertical bars growing from the
+// bottom row, one bar per column, up to one value per column. Values are
+// clamped, missing colors default to white and columns without a value
+// stay black.
+func (g Geometry) RenderBars(values []float64, colors []string) ColorMatrix {
+	matrix := g.MakeMatrix("#000000")
+	for column := 0; column < len(values) && column < g.Cols; column++ {
+		color := "#ffffff"
+		if column < len(colors) {
+			color = colors[column]
+		}
+
+		value := values[column]
+		if math.IsNaN(value) {
+			value = 0
+		}
+		value = math.Max(0, math.Min(1, value))
+		height := int(math.Round(value * float64(g.Rows)))
+		for row := g.Rows - height; row < g.Rows; row++ {
+			matrix.SetHex(Vector{Row: row, Column: column}, color)
+		}
+	}
+
+	return matrix
+}
+
+// orDefault returns DefaultGeometry for a zero geometry
+func (g Geometry) orDefault() Geometry {
+	if g.Rows <= 0 || g.Cols <= 0 {
+		return DefaultGeometry
+	}
+	return g
+}
+
+// parseCoordinates parses a column and row within the geometry
+func (g Geometry) parseCoordinates(xStr, yStr string) (int, int, error) {
+	x, err := parseGridIndex("x coordinate", xStr, g.Cols)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	y, err := parseGridIndex("y coordinate", yStr, g.Rows)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return x, y, nil
+}
+
+// parseGridIndex parses a row, column or coordinate below limit, telling a
+// value that isn't a number apart from one outside the grid
+func parseGridIndex(what, value string, limit int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a whole number, got %q", what, value)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %d (allowed 0-%d)", what, n, limit-1)
+	}
+	if n >= limit {
+		return 0, fmt.Errorf("%s %d is out of range (allowed 0-%d)", what, n, limit-1)
+	}
+	return n, nil
+}
@@ -0,0 +1,188 @@
+package yeelight
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	panel = Geometry{Rows: 5, Cols: 5}
+	strip = Geometry{Rows: 1, Cols: 25}
+)
+
+func TestParseGeometry(t *testing.T) {
+	for _, want := range []Geometry{panel, strip} {
+		g, err := ParseGeometry(want.String())
+		if err != nil || g != want {
+			t.Errorf("%s: got %v, %v", want, g, err)
+		}
+		if g.LEDs() != 25 {
+			t.Errorf("%s: %d LEDs, want 25", g, g.LEDs())
+		}
+	}
+
+	for _, invalid := range []string{"", "5", "0x25", "5x-1", "axb"} {
+		if _, err := ParseGeometry(invalid); err == nil {
+			t.Errorf("%q was accepted", invalid)
+		}
+	}
+}
+
+func TestGeometryIndex(t *testing.T) {
+	tests := []struct {
+		g    Geometry
+		v    Vector
+		want int
+	}{
+		{panel, Vector{Row: 0, Column: 4}, 4},
+		{panel, Vector{Row: 1, Column: 2}, 7},
+		{panel, Vector{Row: 4, Column: 4}, 24},
+		{strip, Vector{Row: 0, Column: 7}, 7},
+		{strip, Vector{Row: 0, Column: 24}, 24},
+	}
+
+	for _, test := range tests {
+		if got := test.g.Index(test.v); got != test.want {
+			t.Errorf("%s %+v: index %d, want %d", test.g, test.v, got, test.want)
+		}
+		matrix := test.g.MakeMatrix("#000000")
+		if got := matrix.index(test.v); got != test.want {
+			t.Errorf("%s %+v: matrix index %d, want %d", test.g, test.v, got, test.want)
+		}
+	}
+}
+
+func TestParseCoordinatesFollowGeometry(t *testing.T) {
+	tests := []struct {
+		g      Geometry
+		source string
+		want   string
+	}{
+		{panel, "PIXEL 5 0 red\n", "line 1: x coordinate 5 is out of range (allowed 0-4)"},
+		{panel, "PIXEL 0 5 red\n", "line 1: y coordinate 5 is out of range (allowed 0-4)"},
+		{strip, "PIXEL 25 0 red\n", "line 1: x coordinate 25 is out of range (allowed 0-24)"},
+		{strip, "PIXEL 0 1 red\n", "line 1: y coordinate 1 is out of range (allowed 0-0)"},
+		{strip, "ROW 1 red\n", "line 1: row 1 is out of range (allowed 0-0)"},
+		{strip, "RAW " + strings.Repeat("A", 96) + "\n", "line 1: RAW requires 100 characters, got 96"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseScriptReaderGeometry("test", strings.NewReader(test.source), test.g)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s %q: got %v, want %q", test.g, test.source, err, test.want)
+		}
+	}
+}
+
+func TestStripScript(t *testing.T) {
+	script, err := ParseScriptReaderGeometry("test", strings.NewReader("PIXEL 24 0 red\nCOL 3 blue\n"), strip)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	frame := script.Frames[0]
+	if len(frame.Colors) != 25 || frame.width() != 25 || frame.rows() != 1 {
+		t.Fatalf("got %d LEDs in %d columns, want 25 in 25", len(frame.Colors), frame.width())
+	}
+	for x, want := range map[int]string{24: "#ff0000", 3: "#0000ff", 0: "#000000"} {
+		if got := pixel(frame, x, 0); got != want {
+			t.Errorf("LED %d is %s, want %s", x, got, want)
+		}
+	}
+}
+
+func TestMatrixFromArtGeometry(t *testing.T) {
+	palette := map[rune]string{'.': "black", 'R': "red"}
+
+	matrix, err := strip.MatrixFromArt("R.......................R", palette)
+	if err != nil {
+		t.Fatalf("strip art failed: %v", err)
+	}
+	if pixel(matrix, 0, 0) != "#ff0000" || pixel(matrix, 24, 0) != "#ff0000" || pixel(matrix, 12, 0) != "#000000" {
+		t.Errorf("strip art drew %v", matrix.ToHexSlice())
+	}
+
+	art := `
+		R....
+		.....
+		..R..
+		.....
+		....R`
+	matrix, err = MatrixFromArt(art, palette)
+	if err != nil {
+		t.Fatalf("panel art failed: %v", err)
+	}
+	if pixel(matrix, 0, 0) != "#ff0000" || pixel(matrix, 2, 2) != "#ff0000" || pixel(matrix, 4, 4) != "#ff0000" || pixel(matrix, 4, 0) != "#000000" {
+		t.Errorf("panel art drew %v", matrix.ToHexSlice())
+	}
+
+	if _, err := strip.MatrixFromArt(art, palette); err == nil || err.Error() != "art has 5 lines, expected 1" {
+		t.Errorf("panel art on a strip: got %v", err)
+	}
+}
+
+func TestRenderBarsGeometry(t *testing.T) {
+	bars := RenderBars([]float64{1, 0.4, 0}, []string{"#ff0000"})
+	for row := 0; row < 5; row++ {
+		if got := pixel(bars, 0, row); got != "#ff0000" {
+			t.Errorf("full bar row %d is %s", row, got)
+		}
+		// 0.4 of 5 rows lights the bottom 2
+		want := "#000000"
+		if row >= 3 {
+			want = "#ffffff"
+		}
+		if got := pixel(bars, 1, row); got != want {
+			t.Errorf("second bar row %d is %s, want %s", row, got, want)
+		}
+	}
+
+	// A strip has a single row, a bar lights once its value rounds up to it
+	values := make([]float64, 30)
+	values[0], values[1], values[24], values[29] = 1, 0.4, 0.6, 1
+	bars = strip.RenderBars(values, nil)
+	for x, want := range map[int]string{0: "#ffffff", 1: "#000000", 24: "#ffffff"} {
+		if got := pixel(bars, x, 0); got != want {
+			t.Errorf("strip LED %d is %s, want %s", x, got, want)
+		}
+	}
+	if len(bars.Colors) != 25 {
+		t.Errorf("strip bars have %d LEDs, want 25", len(bars.Colors))
+	}
+}
+
+func TestSetPixelsFollowsGeometry(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+	yl.Geometry = strip
+
+	if err := yl.SetPixels(map[Vector]Color{{Row: 0, Column: 24}: MakeColorHEX("#ff0000")}); err != nil {
+		t.Fatalf("SetPixels on a strip failed: %v", err)
+	}
+	if got, want := lamp.lastParams(t), `["`+strings.Repeat("AAAA", 24)+redASCII()+`"]`; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+
+	err := yl.SetPixels(map[Vector]Color{{Row: 1, Column: 0}: MakeColorHEX("#ff0000")})
+	if err == nil || !strings.Contains(err.Error(), "allowed rows 0-0, columns 0-24") {
+		t.Errorf("out of range pixel: got %v", err)
+	}
+}
+
+func TestRunnerRejectsFramesOfAnotherSize(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	script, err := ParseScriptReaderGeometry("test", strings.NewReader("FILL red\n"), Geometry{Rows: 2, Cols: 5})
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	err = runner.RunParsed(script, 0, 0)
+	if err == nil || err.Error() != "frame 0 has 10 LEDs, the lamp has 25" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func redASCII() string {
+	red := MakeColorHEX("#ff0000")
+	return red.ToASCII()
+}
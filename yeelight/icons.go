@@ -0,0 +1,97 @@
+package yeelight
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// icons holds the built-in 5x5 bitmaps used by the ICON command.
+// Each row is 5 characters wide, 'X' marks a lit pixel.
+var icons = map[string][5]string{
+	"heart": {
+		".X.X.",
+		"XXXXX",
+		"XXXXX",
+		".XXX.",
+		"..X..",
+	},
+	"smiley": {
+		".X.X.",
+		".X.X.",
+		".....",
+		"X...X",
+		".XXX.",
+	},
+	"arrow-up": {
+		"..X..",
+		".XXX.",
+		"X.X.X",
+		"..X..",
+		"..X..",
+	},
+	"arrow-down": {
+		"..X..",
+		"..X..",
+		"X.X.X",
+		".XXX.",
+		"..X..",
+	},
+	"arrow-left": {
+		"..X..",
+		".X...",
+		"XXXXX",
+		".X...",
+		"..X..",
+	},
+	"arrow-right": {
+		"..X..",
+		"...X.",
+		"XXXXX",
+		"...X.",
+		"..X..",
+	},
+	"check": {
+		".....",
+		"....X",
+		"...X.",
+		"X.X..",
+		".X...",
+	},
+	"x": {
+		"X...X",
+		".X.X.",
+		"..X..",
+		".X.X.",
+		"X...X",
+	},
+}
+
+// drawIcon renders the named built-in icon in the given color onto the matrix.
+// Unlit pixels of the icon leave the matrix untouched.
+func drawIcon(matrix *ColorMatrix, name string, color string) error {
+	icon, ok := icons[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown icon: %s (available: %s)", name, strings.Join(iconNames(), ", "))
+	}
+
+	for y, row := range icon {
+		for x, pixel := range row {
+			// Icons are clipped on matrices smaller than 5x5
+			if v := (Vector{Row: y, Column: x}); pixel == 'X' && matrix.contains(v) {
+				matrix.SetHex(v, color)
+			}
+		}
+	}
+
+	return nil
+}
+
+func iconNames() []string {
+	names := make([]string, 0, len(icons))
+	for name := range icons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,41 @@
+package yeelight
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// LogFields holds the structured fields attached to a log event
+type LogFields map[string]interface{}
+
+// Logger receives script runner lifecycle events such as "start", "stop",
+// "timeout" and "frame_error", along with fields like the script name and
+// frame index
+type Logger interface {
+	Event(name string, fields LogFields)
+}
+
+// stdLogger writes events through the standard log package
+type stdLogger struct{}
+
+// NewStdLogger returns a Logger backed by the standard log package
+func NewStdLogger() Logger {
+	return stdLogger{}
+}
+
+func (stdLogger) Event(name string, fields LogFields) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", key, fields[key]))
+	}
+
+	log.Printf("%s %s", name, strings.Join(pairs, " "))
+}
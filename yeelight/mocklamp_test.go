@@ -0,0 +1,196 @@
+package yeelight
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockLamp is a TCP server speaking the lamp protocol. It records every
+// command and answers with the reply set for its method, or "ok". Asked for
+// music mode it connects back and records the unanswered commands sent over
+// that connection separately.
+type mockLamp struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	commands []Command
+	music    []Command
+	replies  map[string]string
+}
+
+// newMockLamp starts a mock lamp on a local port, closed when the test ends
+func newMockLamp(t *testing.T) *mockLamp {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	lamp := &mockLamp{listener: listener, replies: map[string]string{}}
+	t.Cleanup(func() { listener.Close() })
+	go lamp.serve()
+	return lamp
+}
+
+// client returns a client for the lamp with short timeouts and no retries
+func (m *mockLamp) client() *Yeelight {
+	return &Yeelight{
+		Address:         m.listener.Addr().String(),
+		ConnectTimeout:  time.Second,
+		ResponseTimeout: time.Second,
+		TimeoutRetries:  -1,
+	}
+}
+
+// reply sets the JSON members answering method besides the id, e.g.
+// `"result":["on"]` or `"error":{"code":-1,"message":"unsupported"}`.
+// Empty members leave the method unanswered.
+func (m *mockLamp) reply(method, members string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replies[method] = members
+}
+
+// received returns the commands received so far
+func (m *mockLamp) received() []Command {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Command(nil), m.commands...)
+}
+
+// musicMethods returns the methods received over the music mode connection
+func (m *mockLamp) musicMethods() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var methods []string
+	for _, c := range m.music {
+		methods = append(methods, c.Method)
+	}
+	return methods
+}
+
+// methods returns the methods of the commands received so far
+func (m *mockLamp) methods() []string {
+	var methods []string
+	for _, c := range m.received() {
+		methods = append(methods, c.Method)
+	}
+	return methods
+}
+
+// lastParams returns the params of the last command as JSON
+func (m *mockLamp) lastParams(t *testing.T) string {
+	t.Helper()
+	commands := m.received()
+	if len(commands) == 0 {
+		t.Fatal("the lamp received no command")
+	}
+	params, err := json.Marshal(commands[len(commands)-1].Params)
+	if err != nil {
+		t.Fatalf("failed to encode params: %v", err)
+	}
+	return string(params)
+}
+
+func (m *mockLamp) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+// connectMusic connects back to the music mode port given by set_music
+func (m *mockLamp) connectMusic(c Command) {
+	params, ok := c.Params.([]interface{})
+	if !ok || len(params) != 3 || params[0] != float64(1) {
+		return
+	}
+	host, _ := params[1].(string)
+	port, _ := params[2].(float64)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var c Command
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.music = append(m.music, c)
+		m.mu.Unlock()
+	}
+}
+
+func (m *mockLamp) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var c Command
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.commands = append(m.commands, c)
+		members, ok := m.replies[c.Method]
+		m.mu.Unlock()
+		if !ok {
+			members = `"result":["ok"]`
+		}
+		if members == "" {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(conn, "{\"id\":%d,%s}\r\n", c.ID, members); err != nil {
+			return
+		}
+		if c.Method == "set_music" {
+			go m.connectMusic(c)
+		}
+	}
+}
+
+// discardLogger drops runner events
+type discardLogger struct{}
+
+func (discardLogger) Event(string, LogFields) {}
+
+// newTestRunner returns a runner for a mock lamp, driven by a fake clock.
+// Music mode is disabled, the mock lamp doesn't connect back.
+func newTestRunner(t *testing.T) (*ScriptRunner, *mockLamp, *FakeClock) {
+	t.Helper()
+	lamp := newMockLamp(t)
+	runner := NewScriptRunner(lamp.client())
+	runner.SetLogger(discardLogger{})
+	runner.MusicModeInterval = -1
+	clock := NewFakeClock(time.Unix(0, 0))
+	runner.SetClock(clock)
+	return runner, lamp, clock
+}
+
+// countMethod returns how many times method appears in methods
+func countMethod(methods []string, method string) int {
+	n := 0
+	for _, m := range methods {
+		if m == method {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,288 @@
+package yeelight
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Music mode connection states reported by MusicModeState.
+const (
+	MusicModeOff          = "off"
+	MusicModeConnected    = "connected"
+	MusicModeReconnecting = "reconnecting"
+)
+
+// musicAcceptTimeout limits waiting for the lamp to connect back after
+// set_music
+const musicAcceptTimeout = 3 * time.Second
+
+// musicReconnectDelays are the pauses before each attempt to re-establish
+// a dropped music mode connection. Commands use the regular, rate limited
+// path meanwhile.
+var musicReconnectDelays = []time.Duration{time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second}
+
+// musicState is the music mode connection of a Yeelight
+type musicState struct {
+	mu sync.Mutex
+	// host is the local address given to the lamp, empty when music mode
+	// is off
+	host string
+	// conn is the connection the lamp opened, nil while reconnecting
+	conn         net.Conn
+	reconnecting bool
+}
+
+// isMusicQuery reports whether the method is answered with values. The lamp
+// sends no responses in music mode, so queries and set_music itself always
+// use the regular connection.
+func isMusicQuery(method string) bool {
+	return strings.HasPrefix(method, "get_") || method == "cron_get" || method == "set_music"
+}
+
+// EnableMusicMode switches the lamp to music mode: it listens on a local
+// TCP port, asks the lamp with set_music to connect to localHost, and sends
+// the following commands over that connection, which has no command quota
+// and no responses. Queries (get_* and cron_get) and SendRaw still use
+// regular connections. An empty localHost uses the address of the interface
+// facing the lamp. The port listens on all interfaces, so a lamp connecting
+// back through a different interface than localHost is accepted too. A
+// dropped connection is re-established in the background, see
+// MusicModeState.
+func (yl *Yeelight) EnableMusicMode(localHost string) error {
+	if !yl.Supports("set_music") {
+		return ErrUnsupported
+	}
+
+	if localHost == "" {
+		host, err := yl.localHost()
+		if err != nil {
+			return fmt.Errorf("failed to find the local address facing the lamp: %w", err)
+		}
+		localHost = host
+	}
+
+	yl.music.mu.Lock()
+	if yl.music.host != "" {
+		yl.music.mu.Unlock()
+		return fmt.Errorf("music mode is already enabled")
+	}
+	yl.music.host = localHost
+	yl.music.mu.Unlock()
+
+	conn, err := yl.connectMusic(localHost)
+	if err != nil {
+		yl.music.mu.Lock()
+		yl.music.host = ""
+		yl.music.mu.Unlock()
+		return err
+	}
+
+	yl.setMusicConn(conn)
+	return nil
+}
+
+// DisableMusicMode turns music mode off and closes its connection.
+// Commands use regular connections again.
+func (yl *Yeelight) DisableMusicMode() error {
+	yl.music.mu.Lock()
+	if yl.music.host == "" {
+		yl.music.mu.Unlock()
+		return nil
+	}
+	yl.music.host = ""
+	conn := yl.music.conn
+	yl.music.conn = nil
+	yl.music.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	_, err := yl.SendCommand(Command{Method: "set_music", Params: []interface{}{0}})
+	return err
+}
+
+// MusicModeState reports whether music mode is off, connected, or
+// reconnecting after the lamp dropped the connection.
+func (yl *Yeelight) MusicModeState() string {
+	yl.music.mu.Lock()
+	defer yl.music.mu.Unlock()
+
+	switch {
+	case yl.music.host == "":
+		return MusicModeOff
+	case yl.music.conn != nil:
+		return MusicModeConnected
+	default:
+		return MusicModeReconnecting
+	}
+}
+
+// connectMusic asks the lamp to connect to host and waits for it
+func (yl *Yeelight) connectMusic(host string) (net.Conn, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for music mode: %w", err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	if _, err := yl.SendCommand(Command{Method: "set_music", Params: []interface{}{1, host, port}}); err != nil {
+		return nil, err
+	}
+
+	lampHost, _, err := net.SplitHostPort(yl.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(musicAcceptTimeout))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, fmt.Errorf("lamp didn't connect for music mode: %w", err)
+		}
+		// Ignore anything else that found the port
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok && sameHost(remote.IP, lampHost) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// sameHost reports whether ip is the address of host, which may be a name
+func sameHost(ip net.IP, host string) bool {
+	if hostIP := net.ParseIP(host); hostIP != nil {
+		return hostIP.Equal(ip)
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// localHost returns the local address of the interface used to reach the
+// lamp. Dialing UDP sends nothing, it only picks the route.
+func (yl *Yeelight) localHost() (string, error) {
+	conn, err := net.Dial("udp", yl.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// setMusicConn installs a music mode connection and watches it for the lamp
+// closing it
+func (yl *Yeelight) setMusicConn(conn net.Conn) {
+	yl.music.mu.Lock()
+	yl.music.conn = conn
+	yl.music.reconnecting = false
+	yl.music.mu.Unlock()
+
+	go func() {
+		// The lamp sends nothing in music mode, reading returns when the
+		// connection is closed
+		io.Copy(io.Discard, conn)
+		yl.musicDropped(conn)
+	}()
+}
+
+// musicDropped forgets a closed music mode connection and starts
+// reconnecting, unless music mode was disabled meanwhile
+func (yl *Yeelight) musicDropped(conn net.Conn) {
+	conn.Close()
+
+	yl.music.mu.Lock()
+	if yl.music.conn == conn {
+		yl.music.conn = nil
+	}
+	start := yl.music.host != "" && yl.music.conn == nil && !yl.music.reconnecting
+	if start {
+		yl.music.reconnecting = true
+	}
+	yl.music.mu.Unlock()
+
+	if start {
+		go yl.reconnectMusic()
+	}
+}
+
+// reconnectMusic reissues set_music until the lamp connects again or music
+// mode is disabled. After the last attempt music mode is turned off.
+func (yl *Yeelight) reconnectMusic() {
+	for _, delay := range musicReconnectDelays {
+		time.Sleep(delay)
+
+		yl.music.mu.Lock()
+		host := yl.music.host
+		yl.music.mu.Unlock()
+		if host == "" {
+			return
+		}
+
+		conn, err := yl.connectMusic(host)
+		if err != nil {
+			continue
+		}
+
+		// Music mode may have been disabled while connecting
+		yl.music.mu.Lock()
+		disabled := yl.music.host == ""
+		yl.music.mu.Unlock()
+		if disabled {
+			conn.Close()
+			return
+		}
+
+		yl.setMusicConn(conn)
+		return
+	}
+
+	yl.music.mu.Lock()
+	yl.music.host = ""
+	yl.music.reconnecting = false
+	yl.music.mu.Unlock()
+}
+
+// sendMusic writes the command over the music mode connection. ok is false
+// when music mode isn't connected or the write failed, and the command must
+// be sent the regular way.
+func (yl *Yeelight) sendMusic(c Command) (r Response, ok bool) {
+	if isMusicQuery(c.Method) {
+		return r, false
+	}
+
+	yl.music.mu.Lock()
+	defer yl.music.mu.Unlock()
+
+	if yl.music.conn == nil {
+		return r, false
+	}
+
+	cmdJSON, err := c.ToJson()
+	if err != nil {
+		return r, false
+	}
+
+	yl.music.conn.SetWriteDeadline(time.Now().Add(yl.responseTimeout()))
+	if _, err := fmt.Fprintf(yl.music.conn, "%s\r\n", cmdJSON); err != nil {
+		// The watcher notices the closed connection and reconnects
+		yl.music.conn.Close()
+		return r, false
+	}
+
+	// The lamp doesn't answer in music mode, assume success
+	return Response{ID: c.ID, Result: []interface{}{"ok"}}, true
+}
@@ -0,0 +1,43 @@
+package yeelight
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMusicModeKeepsQueriesOnRegularConnection(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+	if err := yl.EnableMusicMode("127.0.0.1"); err != nil {
+		t.Fatalf("failed to enable music mode: %v", err)
+	}
+	defer yl.DisableMusicMode()
+	waitFor(t, "the lamp to connect back", func() bool { return yl.MusicModeState() == MusicModeConnected })
+
+	if err := yl.SetOn(DefaultOptions); err != nil {
+		t.Fatalf("SetOn failed: %v", err)
+	}
+	waitFor(t, "set_power over music mode", func() bool { return len(lamp.musicMethods()) == 1 })
+
+	lamp.reply("get_prop", `"result":["on"]`)
+	if r, err := yl.GetProperty("power"); err != nil || !slices.Equal(r.Result.([]interface{}), []interface{}{"on"}) {
+		t.Errorf("get_prop: got %v, %v, want the lamp's answer", r.Result, err)
+	}
+
+	lamp.reply("cron_get", `"result":[{"type":0,"delay":15,"mix":0}]`)
+	if minutes, err := yl.GetDelayOff(); err != nil || minutes != 15 {
+		t.Errorf("cron_get: got %d, %v, want 15", minutes, err)
+	}
+
+	lamp.reply("set_ps", `"error":{"code":-1,"message":"unsupported"}`)
+	if r, err := yl.SendRaw("set_ps", "cfg_lan_ctrl", "1"); err != nil || r.Error == nil {
+		t.Errorf("SendRaw: got %v, %v, want the lamp's error", r, err)
+	}
+
+	if got, want := lamp.musicMethods(), []string{"set_power"}; !slices.Equal(got, want) {
+		t.Errorf("sent %v over music mode, want %v", got, want)
+	}
+	if got, want := lamp.methods(), []string{"set_music", "get_prop", "cron_get", "set_ps"}; !slices.Equal(got, want) {
+		t.Errorf("sent %v over regular connections, want %v", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package yeelight
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RunPlaylist plays the given script files one after another, each script's
+// frames once, and repeats the whole playlist loops times (0 means forever).
+// StopScript stops the playlist along with the script currently playing.
+func (sr *ScriptRunner) RunPlaylist(scriptNames []string, interval time.Duration, loops int) error {
+	if len(scriptNames) == 0 {
+		return fmt.Errorf("playlist is empty")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("playlist interval must be positive")
+	}
+	if loops < 0 {
+		return fmt.Errorf("playlist loops must not be negative")
+	}
+
+	// Parse all scripts up front so a broken script fails the request
+	// instead of stopping the playlist halfway through
+	scripts := make([]*Script, 0, len(scriptNames))
+	for _, name := range scriptNames {
+		script, err := ParseScriptGeometry(name, sr.yeelight.geometry())
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		scripts = append(scripts, script)
+	}
+
+	ctx, err := sr.reserve()
+	if err != nil {
+		return err
+	}
+
+	sr.mu.Lock()
+	sr.currentScript = scripts[0]
+	sr.interval = interval
+	sr.mu.Unlock()
+
+	// Enable the lamp, in direct mode if any script needs it
+	directMode := false
+	for _, script := range scripts {
+		directMode = directMode || script.DirectMode
+	}
+	if err := sr.prepareLamp(scripts[0].Name, directMode, scripts[0].Frames[0]); err != nil {
+		sr.abortStart()
+		return err
+	}
+
+	sr.logger.Event("start", LogFields{"playlist": scriptNames, "interval": interval, "loops": loops})
+
+	go sr.runPlaylistLoop(ctx, scripts, interval, loops)
+
+	return nil
+}
+
+// runPlaylistLoop plays the scripts in order, loading the next one when the
+// current script has shown all of its frames
+func (sr *ScriptRunner) runPlaylistLoop(ctx context.Context, scripts []*Script, interval time.Duration, loops int) {
+	defer func() {
+		sr.finish(recover())
+	}()
+
+	// Turn off the lamp when the playlist ends, see KeepLastFrame
+	defer sr.leaveLamp()
+
+	sr.resetDisplay()
+
+	ticker := sr.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for loop := 0; loops == 0 || loop < loops; loop++ {
+		for _, script := range scripts {
+			sr.mu.Lock()
+			sr.currentScript = script
+			sr.mu.Unlock()
+
+			for frameIndex := range script.Frames {
+				sr.display(script, frameIndex)
+
+				// Wait for next frame or stop signal
+				select {
+				case <-ticker.C():
+				case <-ctx.Done():
+					sr.logger.Event("stop", LogFields{"script": script.Name})
+					return
+				}
+			}
+		}
+	}
+
+	sr.logger.Event("stop", LogFields{"playlist": len(scripts), "loops": loops})
+}
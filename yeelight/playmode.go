@@ -0,0 +1,77 @@
+package yeelight
+
+import "fmt"
+
+// PlayMode is the order in which the runner plays a script's frames.
+type PlayMode int
+
+const (
+	// PlayForward plays the frames from first to last, then starts over
+	PlayForward PlayMode = iota
+	// PlayReverse plays the frames from last to first, then starts over
+	PlayReverse
+	// PlayPingPong plays the frames forward and then backward, without
+	// showing the first and last frame twice in a row
+	PlayPingPong
+)
+
+// ParsePlayMode parses "forward", "reverse" or "pingpong". An empty string
+// is PlayForward.
+func ParsePlayMode(s string) (PlayMode, error) {
+	switch s {
+	case "", "forward":
+		return PlayForward, nil
+	case "reverse":
+		return PlayReverse, nil
+	case "pingpong":
+		return PlayPingPong, nil
+	}
+	return PlayForward, fmt.Errorf("invalid play mode: %s (must be forward, reverse or pingpong)", s)
+}
+
+func (m PlayMode) String() string {
+	switch m {
+	case PlayReverse:
+		return "reverse"
+	case PlayPingPong:
+		return "pingpong"
+	}
+	return "forward"
+}
+
+// frameOrder steps through frame indexes in a play mode
+type frameOrder struct {
+	mode      PlayMode
+	count     int
+	index     int
+	direction int
+}
+
+func newFrameOrder(mode PlayMode, count int) *frameOrder {
+	order := &frameOrder{mode: mode, count: count, direction: 1}
+	if mode == PlayReverse {
+		order.index = count - 1
+	}
+	return order
+}
+
+// next advances to the following frame and returns its index
+func (o *frameOrder) next() int {
+	if o.count <= 1 {
+		return 0
+	}
+
+	switch o.mode {
+	case PlayReverse:
+		o.index = (o.index - 1 + o.count) % o.count
+	case PlayPingPong:
+		// Turn around at either end, the end frame isn't repeated
+		if o.index+o.direction < 0 || o.index+o.direction >= o.count {
+			o.direction = -o.direction
+		}
+		o.index += o.direction
+	default:
+		o.index = (o.index + 1) % o.count
+	}
+	return o.index
+}
@@ -0,0 +1,202 @@
+package yeelight
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultPoolIdleTimeout is how long a pooled connection may stay unused
+// before it is closed. Lamps drop connections idle for about a minute, so
+// the pool closes them first.
+const DefaultPoolIdleTimeout = 50 * time.Second
+
+// poolKeepAlive is the TCP keep-alive period of pooled connections
+const poolKeepAlive = 15 * time.Second
+
+// ConnPool keeps one open connection per lamp address, shared by all
+// clients using the pool, so a server driving many lamps doesn't dial for
+// every command. Commands on the same lamp are serialized. Set it as
+// Yeelight.Pool; clients without a pool dial per command as before.
+type ConnPool struct {
+	// IdleTimeout closes connections unused for longer. 0 uses
+	// DefaultPoolIdleTimeout.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[string]*pooledConn
+	stop   chan struct{}
+	closed bool
+}
+
+// pooledConn is the connection to one lamp. mu is held for the whole
+// command, from checkout to release.
+type pooledConn struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+	lastUsed time.Time
+}
+
+// ErrPoolClosed is returned for commands sent through a closed pool.
+var ErrPoolClosed = errors.New("connection pool is closed")
+
+// NewConnPool creates a pool and starts reaping idle connections. Call
+// Close when done with it.
+func NewConnPool(idleTimeout time.Duration) *ConnPool {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultPoolIdleTimeout
+	}
+
+	p := &ConnPool{
+		IdleTimeout: idleTimeout,
+		conns:       map[string]*pooledConn{},
+		stop:        make(chan struct{}),
+	}
+	go p.reapLoop()
+	return p
+}
+
+// Close closes all pooled connections and stops the reaper. Commands sent
+// afterwards fail with ErrPoolClosed.
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.stop)
+	conns := p.conns
+	p.conns = map[string]*pooledConn{}
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.mu.Lock()
+		pc.close()
+		pc.mu.Unlock()
+	}
+}
+
+// acquire checks out the connection to address, dialing when there is
+// none or the pooled one is no longer healthy. The caller must release it.
+func (p *ConnPool) acquire(address string, connectTimeout time.Duration) (*pooledConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	pc, ok := p.conns[address]
+	if !ok {
+		pc = &pooledConn{}
+		p.conns[address] = pc
+	}
+	p.mu.Unlock()
+
+	pc.mu.Lock()
+	if pc.conn != nil && (time.Since(pc.lastUsed) > p.IdleTimeout || !pc.healthy()) {
+		pc.close()
+	}
+
+	if pc.conn == nil {
+		if connectTimeout == 0 {
+			connectTimeout = 3 * time.Second
+		}
+		dialer := net.Dialer{Timeout: connectTimeout, KeepAlive: poolKeepAlive}
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			pc.mu.Unlock()
+			return nil, err
+		}
+		pc.conn = conn
+		pc.reader = bufio.NewReader(conn)
+	}
+
+	return pc, nil
+}
+
+// release returns a connection to the pool. A broken connection, e.g. one
+// that timed out and may still receive a late response, is closed.
+func (p *ConnPool) release(pc *pooledConn, broken bool) {
+	if broken {
+		pc.close()
+	}
+	pc.lastUsed = time.Now()
+	pc.mu.Unlock()
+}
+
+// healthy reports whether the lamp hasn't closed the connection, see
+// connAlive
+func (pc *pooledConn) healthy() bool {
+	return connAlive(pc.conn, pc.reader)
+}
+
+// connAlive reports whether the lamp hasn't closed conn, without waiting:
+// a read that would block means the connection is still open. Pending
+// notifications are left in the reader.
+func connAlive(conn net.Conn, reader *bufio.Reader) bool {
+	conn.SetReadDeadline(time.Now())
+	_, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+
+	var netErr net.Error
+	return err == nil || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// close closes the connection, the next checkout dials a new one
+func (pc *pooledConn) close() {
+	if pc.conn != nil {
+		pc.conn.Close()
+		pc.conn = nil
+		pc.reader = nil
+	}
+}
+
+// reapLoop periodically closes connections idle for longer than
+// IdleTimeout, before the lamp drops them
+func (p *ConnPool) reapLoop() {
+	ticker := time.NewTicker(p.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		conns := make([]*pooledConn, 0, len(p.conns))
+		for _, pc := range p.conns {
+			conns = append(conns, pc)
+		}
+		p.mu.Unlock()
+
+		for _, pc := range conns {
+			// A connection in use is busy, not idle
+			if !pc.mu.TryLock() {
+				continue
+			}
+			if pc.conn != nil && time.Since(pc.lastUsed) > p.IdleTimeout {
+				pc.close()
+			}
+			pc.mu.Unlock()
+		}
+	}
+}
+
+// sendPooled sends the command over the pooled connection to the lamp
+func (yl *Yeelight) sendPooled(c Command) (r Response, timedOut bool, err error) {
+	pc, err := yl.Pool.acquire(yl.Address, yl.connectTimeout())
+	if err != nil {
+		return r, false, err
+	}
+
+	r, timedOut, err = yl.exchange(pc.conn, pc.reader, c)
+	// A quota error is a regular response, anything else leaves the
+	// connection in an unknown state
+	yl.Pool.release(pc, timedOut || (err != nil && !errors.Is(err, ErrQuotaExceeded)))
+	return r, timedOut, err
+}
@@ -2,7 +2,9 @@ package yeelight
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"strconv"
@@ -15,59 +17,216 @@ import (
 type Script struct {
 	Name   string
 	Frames []ColorMatrix
+	// Meta holds the "# @key value" header lines found at the top of the script
+	Meta map[string]string
+	// Warnings lists suspicious but valid constructs, such as blank frames
+	Warnings []string
+	// DirectMode is set when the script draws matrix frames, which need the
+	// lamp in direct LED mode. The parser sets it for every command but BG;
+	// without it the runner only sets the ambient light of each frame.
+	DirectMode bool
+	// Backgrounds maps frame indexes to the ambient light color set by BG
+	// while the frame is shown
+	Backgrounds map[int]string
+	// PlayMode is the order the runner plays the frames in. Playlists
+	// always play forward.
+	PlayMode PlayMode
 }
 
 // ScriptRunner manages script execution
 type ScriptRunner struct {
 	yeelight      *Yeelight
 	currentScript *Script
-	stopChan      chan bool
-	mu            sync.Mutex
-	isRunning     bool
+	// cancel stops the loop of the running script, done is closed once
+	// the loop has finished. Both are replaced for every run.
+	cancel    context.CancelFunc
+	done      chan struct{}
+	mu        sync.Mutex
+	isRunning bool
+	logger    Logger
+	// interval, frameIndex and startedAt describe the running script for
+	// Status
+	interval      time.Duration
+	frameIndex    int
+	startedAt     time.Time
+	clock         Clock
+	lastDisplayed ColorMatrix
+
+	// OnStop, if set, is called when a script stops playing. err is nil
+	// after a regular stop or timeout, and describes the panic when the
+	// loop crashed.
+	OnStop func(err error)
+
+	// Afterimage (0.0-1.0) blends each displayed frame over a copy of the
+	// previously displayed frame decayed by this factor, so bright pixels
+	// linger briefly as they fade. 0 disables the effect.
+	Afterimage float64
+
+	// PowerCheckInterval, if set, makes the runner read the power state at
+	// most this often while playing and turn the lamp back on in direct
+	// mode when it was switched off externally. Each check costs a command
+	// from the lamp's quota, so keep it at several seconds or more.
+	PowerCheckInterval time.Duration
+	lastPowerCheck     time.Time
+
+	// KeepLastFrame leaves the last displayed frame on the lamp when a
+	// script stops or times out, e.g. for a sign or status display. By
+	// default the lamp is turned off.
+	KeepLastFrame bool
+
+	// MusicModeInterval makes RunScript switch the lamp to music mode for
+	// intervals below it, which would exceed the command quota otherwise.
+	// 0 uses DefaultMusicModeInterval, a negative value disables it.
+	MusicModeInterval time.Duration
+	// musicMode is set when the runner enabled music mode for the script
+	// it plays, and disables it when the script ends
+	musicMode bool
 }
 
+// DefaultMusicModeInterval is the frame interval below which scripts are
+// played in music mode. The lamp accepts about one command per second
+// outside of it.
+const DefaultMusicModeInterval = time.Second
+
 // NewScriptRunner creates a new script runner instance
 func NewScriptRunner(yl *Yeelight) *ScriptRunner {
 	return &ScriptRunner{
 		yeelight: yl,
-		stopChan: make(chan bool),
+		logger:   NewStdLogger(),
+		clock:    RealClock(),
 	}
 }
 
-// ParseScript reads and parses a script file
+// SetClock replaces the clock driving frame timing, e.g. with a FakeClock
+// in tests. Call it before starting a script.
+func (sr *ScriptRunner) SetClock(clock Clock) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.clock = clock
+}
+
+// SetLogger replaces the logger receiving runner lifecycle events. Call it
+// before starting a script.
+func (sr *ScriptRunner) SetLogger(logger Logger) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.logger = logger
+}
+
+// ParseScript reads and parses a script file for the default 5x5 matrix
 func ParseScript(filename string) (*Script, error) {
+	return ParseScriptGeometry(filename, DefaultGeometry)
+}
+
+// ParseScriptGeometry reads and parses a script file for a matrix of the
+// given geometry. Coordinates outside of it are errors.
+func ParseScriptGeometry(filename string, g Geometry) (*Script, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open script file: %w", err)
 	}
 	defer file.Close()
 
+	return ParseScriptReaderGeometry(filename, file, g)
+}
+
+// ParseScriptReader parses a script read from r, such as stdin. name is
+// used as the script name.
+func ParseScriptReader(name string, r io.Reader) (*Script, error) {
+	return ParseScriptReaderGeometry(name, r, DefaultGeometry)
+}
+
+// ParseScriptReaderGeometry parses a script read from r for a matrix of the
+// given geometry, see ParseScriptReader.
+func ParseScriptReaderGeometry(name string, r io.Reader, g Geometry) (*Script, error) {
+	g = g.orDefault()
 	script := &Script{
-		Name:   filename,
+		Name:   name,
 		Frames: []ColorMatrix{},
+		Meta:   map[string]string{},
+
+		Backgrounds: map[int]string{},
 	}
 
-	currentMatrix := MakeMatrix("#000000", 25)
-	scanner := bufio.NewScanner(file)
+	currentMatrix := g.MakeMatrix("#000000")
+	background := ""
+	scanner := bufio.NewScanner(r)
 	lineNum := 0
 	hasContent := false
 
+	// Sprites defined so far, and the one currently being defined
+	sprites := map[string]sprite{}
+	var spriteName string
+	var spriteDef *sprite
+
+	// Side A and direction of an open SPLIT block
+	var splitSide *ColorMatrix
+	var splitDirection string
+
+	// First lines where a blank line and a FRAME command ended a frame,
+	// to warn about scripts mixing both styles
+	blankSeparatorLine, frameSeparatorLine := 0, 0
+
+	// Open REPEAT blocks, innermost last
+	var repeats []repeatBlock
+
+	// endFrame adds the frame being built, if anything was drawn, and
+	// starts a new black one
+	endFrame := func() bool {
+		if !hasContent {
+			return false
+		}
+		script.addFrame(currentMatrix, background, lineNum)
+		currentMatrix = g.MakeMatrix("#000000")
+		background = ""
+		hasContent = false
+		return true
+	}
+
 	for scanner.Scan() {
 		lineNum++
 		line := strings.TrimSpace(scanner.Text())
 
+		// Inside a sprite definition every non-empty line is a bitmap row
+		if spriteDef != nil {
+			if line == "" {
+				continue
+			}
+			if strings.ToUpper(line) == "ENDSPRITE" {
+				sprites[spriteName] = *spriteDef
+				spriteDef = nil
+				continue
+			}
+			if len(spriteDef.rows) == 5 {
+				return nil, fmt.Errorf("line %d: sprite %s has more than 5 rows", lineNum, spriteName)
+			}
+			row, err := parseSpriteRow(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			spriteDef.rows = append(spriteDef.rows, row)
+			continue
+		}
+
 		// Skip empty lines and comments
 		if line == "" {
-			if hasContent {
-				// Empty line means new frame
-				script.Frames = append(script.Frames, currentMatrix)
-				currentMatrix = MakeMatrix("#000000", 25)
-				hasContent = false
+			if splitSide != nil {
+				return nil, fmt.Errorf("line %d: SPLIT is missing ENDSPLIT before the end of the frame", lineNum)
+			}
+			// Empty line means new frame
+			if endFrame() && blankSeparatorLine == 0 {
+				blankSeparatorLine = lineNum
 			}
 			continue
 		}
 
 		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			// Metadata header lines before the first command
+			if len(script.Frames) == 0 && !hasContent {
+				if key, value, ok := parseMetaLine(line); ok {
+					script.Meta[key] = value
+				}
+			}
 			continue
 		}
 
@@ -78,7 +237,70 @@ func ParseScript(filename string) (*Script, error) {
 		}
 
 		cmd := strings.ToUpper(parts[0])
+
+		// Sprite definitions don't draw anything on the current frame
+		if cmd == "SPRITE" {
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("line %d: SPRITE requires a name", lineNum)
+			}
+			spriteName = strings.ToLower(parts[1])
+			spriteDef = &sprite{}
+			continue
+		}
+		if cmd == "ENDSPRITE" {
+			return nil, fmt.Errorf("line %d: ENDSPRITE without SPRITE", lineNum)
+		}
+
+		// FRAME without arguments ends the frame like a blank line, FRAME
+		// with coordinates draws an outline
+		if cmd == "FRAME" && len(parts) == 1 {
+			if splitSide != nil {
+				return nil, fmt.Errorf("line %d: SPLIT is missing ENDSPLIT before the end of the frame", lineNum)
+			}
+			if endFrame() && frameSeparatorLine == 0 {
+				frameSeparatorLine = lineNum
+			}
+			continue
+		}
+
+		// REPEAT blocks start and end on frame boundaries
+		if cmd == "REPEAT" || cmd == "ENDREPEAT" {
+			if splitSide != nil {
+				return nil, fmt.Errorf("line %d: SPLIT is missing ENDSPLIT before %s", lineNum, cmd)
+			}
+			endFrame()
+
+			if cmd == "REPEAT" {
+				if len(parts) < 2 {
+					return nil, fmt.Errorf("line %d: REPEAT requires a count", lineNum)
+				}
+				count, err := strconv.Atoi(parts[1])
+				if err != nil || count < 1 {
+					return nil, fmt.Errorf("line %d: invalid repeat count: %s (must be 1 or more)", lineNum, parts[1])
+				}
+				if len(repeats) == maxRepeatDepth {
+					return nil, fmt.Errorf("line %d: REPEAT blocks nested deeper than %d", lineNum, maxRepeatDepth)
+				}
+				repeats = append(repeats, repeatBlock{count: count, start: len(script.Frames), line: lineNum})
+				continue
+			}
+
+			if len(repeats) == 0 {
+				return nil, fmt.Errorf("line %d: ENDREPEAT without REPEAT", lineNum)
+			}
+			block := repeats[len(repeats)-1]
+			repeats = repeats[:len(repeats)-1]
+			if err := script.repeatFrames(block); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			continue
+		}
+
 		hasContent = true
+		// Every command but BG draws on the matrix
+		if cmd != "BG" {
+			script.DirectMode = true
+		}
 
 		switch cmd {
 		case "FILL":
@@ -94,11 +316,24 @@ func ParseScript(filename string) (*Script, error) {
 		case "CLEAR":
 			currentMatrix.ReplaceAllHex("#000000")
 
+		case "BG":
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("line %d: BG requires a color", lineNum)
+			}
+			color, err := parseColor(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			if color == "#000000" {
+				return nil, fmt.Errorf("line %d: BG color must not be black", lineNum)
+			}
+			background = color
+
 		case "PIXEL":
 			if len(parts) < 4 {
 				return nil, fmt.Errorf("line %d: PIXEL requires x y color", lineNum)
 			}
-			x, y, err := parseCoordinates(parts[1], parts[2])
+			x, y, err := g.parseCoordinates(parts[1], parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
@@ -112,15 +347,15 @@ func ParseScript(filename string) (*Script, error) {
 			if len(parts) < 3 {
 				return nil, fmt.Errorf("line %d: ROW requires row color", lineNum)
 			}
-			row, err := strconv.Atoi(parts[1])
-			if err != nil || row < 0 || row > 4 {
-				return nil, fmt.Errorf("line %d: invalid row number", lineNum)
+			row, err := parseGridIndex("row", parts[1], g.Rows)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
 			color, err := parseColor(parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
-			for x := 0; x < 5; x++ {
+			for x := 0; x < g.Cols; x++ {
 				currentMatrix.SetHex(Vector{Row: row, Column: x}, color)
 			}
 
@@ -128,15 +363,15 @@ func ParseScript(filename string) (*Script, error) {
 			if len(parts) < 3 {
 				return nil, fmt.Errorf("line %d: COL requires column color", lineNum)
 			}
-			col, err := strconv.Atoi(parts[1])
-			if err != nil || col < 0 || col > 4 {
-				return nil, fmt.Errorf("line %d: invalid column number", lineNum)
+			col, err := parseGridIndex("column", parts[1], g.Cols)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
 			color, err := parseColor(parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
-			for y := 0; y < 5; y++ {
+			for y := 0; y < g.Rows; y++ {
 				currentMatrix.SetHex(Vector{Row: y, Column: col}, color)
 			}
 
@@ -144,7 +379,7 @@ func ParseScript(filename string) (*Script, error) {
 			if len(parts) < 5 {
 				return nil, fmt.Errorf("line %d: CIRCLE requires x y radius color", lineNum)
 			}
-			x, y, err := parseCoordinates(parts[1], parts[2])
+			x, y, err := g.parseCoordinates(parts[1], parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
@@ -162,7 +397,7 @@ func ParseScript(filename string) (*Script, error) {
 			if len(parts) < 5 {
 				return nil, fmt.Errorf("line %d: RING requires x y radius color", lineNum)
 			}
-			x, y, err := parseCoordinates(parts[1], parts[2])
+			x, y, err := g.parseCoordinates(parts[1], parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
@@ -176,15 +411,15 @@ func ParseScript(filename string) (*Script, error) {
 			}
 			drawRing(&currentMatrix, x, y, radius, color)
 
-		case "RECT":
+		case "RECT", "FRAME":
 			if len(parts) < 6 {
-				return nil, fmt.Errorf("line %d: RECT requires x1 y1 x2 y2 color", lineNum)
+				return nil, fmt.Errorf("line %d: %s requires x1 y1 x2 y2 color", lineNum, cmd)
 			}
-			x1, y1, err := parseCoordinates(parts[1], parts[2])
+			x1, y1, err := g.parseCoordinates(parts[1], parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
-			x2, y2, err := parseCoordinates(parts[3], parts[4])
+			x2, y2, err := g.parseCoordinates(parts[3], parts[4])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
@@ -192,17 +427,18 @@ func ParseScript(filename string) (*Script, error) {
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
-			drawRect(&currentMatrix, x1, y1, x2, y2, color)
+			// FRAME draws only the border of the rectangle
+			drawRect(&currentMatrix, x1, y1, x2, y2, color, cmd == "RECT")
 
 		case "LINE":
 			if len(parts) < 6 {
 				return nil, fmt.Errorf("line %d: LINE requires x1 y1 x2 y2 color", lineNum)
 			}
-			x1, y1, err := parseCoordinates(parts[1], parts[2])
+			x1, y1, err := g.parseCoordinates(parts[1], parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
-			x2, y2, err := parseCoordinates(parts[3], parts[4])
+			x2, y2, err := g.parseCoordinates(parts[3], parts[4])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
@@ -216,7 +452,7 @@ func ParseScript(filename string) (*Script, error) {
 			if len(parts) < 5 {
 				return nil, fmt.Errorf("line %d: CROSS requires x y size color", lineNum)
 			}
-			x, y, err := parseCoordinates(parts[1], parts[2])
+			x, y, err := g.parseCoordinates(parts[1], parts[2])
 			if err != nil {
 				return nil, fmt.Errorf("line %d: %w", lineNum, err)
 			}
@@ -256,152 +492,999 @@ func ParseScript(filename string) (*Script, error) {
 				return nil, fmt.Errorf("line %d: invalid dim factor (must be 0.0-1.0)", lineNum)
 			}
 			dimMatrix(&currentMatrix, factor)
+			// Pixels drawn later in the frame keep full brightness
+			currentMatrix = currentMatrix.Flatten()
+
+		case "ICON":
+			if len(parts) < 3 {
+				return nil, fmt.Errorf("line %d: ICON requires name color", lineNum)
+			}
+			color, err := parseColor(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			if err := drawIcon(&currentMatrix, parts[1], color); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+
+		case "CTGRADIENT":
+			if len(parts) < 4 {
+				return nil, fmt.Errorf("line %d: CTGRADIENT requires direction kelvinA kelvinB", lineNum)
+			}
+			direction := strings.ToUpper(parts[1])
+			if direction != "H" && direction != "V" {
+				return nil, fmt.Errorf("line %d: invalid direction: %s (must be H or V)", lineNum, parts[1])
+			}
+			kelvinA, err := parseKelvin(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			kelvinB, err := parseKelvin(parts[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			drawCTGradient(&currentMatrix, direction, kelvinA, kelvinB)
+
+		case "GRADIENT":
+			if len(parts) < 7 {
+				return nil, fmt.Errorf("line %d: GRADIENT requires x1 y1 color1 x2 y2 color2", lineNum)
+			}
+			x1, y1, err := g.parseCoordinates(parts[1], parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			color1, err := parseColor(parts[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			x2, y2, err := g.parseCoordinates(parts[4], parts[5])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			color2, err := parseColor(parts[6])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			if x1 == x2 && y1 == y2 {
+				return nil, fmt.Errorf("line %d: GRADIENT endpoints must differ", lineNum)
+			}
+			drawGradient(&currentMatrix, x1, y1, MakeColorHEX(color1), x2, y2, MakeColorHEX(color2))
+
+		case "TINT":
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("line %d: TINT requires a color", lineNum)
+			}
+			color, err := parseColor(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			tintMatrix(&currentMatrix, MakeColorHEX(color))
+
+		case "INVERTV":
+			invertValueMatrix(&currentMatrix)
+
+		case "RAW":
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("line %d: RAW requires an update_leds ASCII string", lineNum)
+			}
+			if len(parts[1]) != g.LEDs()*asciiCharsPerLED {
+				return nil, fmt.Errorf("line %d: RAW requires %d characters, got %d", lineNum, g.LEDs()*asciiCharsPerLED, len(parts[1]))
+			}
+			matrix, err := MatrixFromASCII(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			matrix.Width = g.Cols
+			currentMatrix = matrix
+
+		case "VIGNETTE":
+			if len(parts) < 3 {
+				return nil, fmt.Errorf("line %d: VIGNETTE requires centerFactor edgeFactor", lineNum)
+			}
+			centerFactor, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || centerFactor < 0 || centerFactor > 1 {
+				return nil, fmt.Errorf("line %d: invalid center factor (must be 0.0-1.0)", lineNum)
+			}
+			edgeFactor, err := strconv.ParseFloat(parts[2], 64)
+			if err != nil || edgeFactor < 0 || edgeFactor > 1 {
+				return nil, fmt.Errorf("line %d: invalid edge factor (must be 0.0-1.0)", lineNum)
+			}
+			vignetteMatrix(&currentMatrix, centerFactor, edgeFactor)
+
+		case "STAMP":
+			if len(parts) < 4 {
+				return nil, fmt.Errorf("line %d: STAMP requires name x y", lineNum)
+			}
+			stamp, ok := sprites[strings.ToLower(parts[1])]
+			if !ok {
+				return nil, fmt.Errorf("line %d: undefined sprite: %s", lineNum, parts[1])
+			}
+			x, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid x offset: %s", lineNum, parts[2])
+			}
+			y, err := strconv.Atoi(parts[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid y offset: %s", lineNum, parts[3])
+			}
+			stampSprite(&currentMatrix, stamp, x, y)
+
+		case "FADE":
+			if len(parts) < 3 {
+				return nil, fmt.Errorf("line %d: FADE requires frames color [easing]", lineNum)
+			}
+			steps, err := strconv.Atoi(parts[1])
+			if err != nil || steps < 1 {
+				return nil, fmt.Errorf("line %d: invalid frame count: %s", lineNum, parts[1])
+			}
+			color, err := parseColor(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			easing := Linear
+			if len(parts) > 3 {
+				easing, err = ParseEasing(parts[3])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNum, err)
+				}
+			}
+			// The starting frame, the transition, and the target as the
+			// current frame
+			from, target := currentMatrix, g.MakeMatrix(color)
+			currentMatrix, err = script.generateFrames(lineNum, cmd, steps+1, func(step int) ColorMatrix {
+				return fadeFrame(from, target, step, steps, easing)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+		case "SPLIT":
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("line %d: SPLIT requires V or H", lineNum)
+			}
+			if splitSide != nil {
+				return nil, fmt.Errorf("line %d: SPLIT blocks can't be nested", lineNum)
+			}
+			splitDirection = strings.ToUpper(parts[1])
+			if splitDirection != "V" && splitDirection != "H" {
+				return nil, fmt.Errorf("line %d: invalid split direction: %s (must be V or H)", lineNum, parts[1])
+			}
+			// Side A is the frame drawn so far, side B starts blank
+			side := currentMatrix
+			splitSide = &side
+			currentMatrix = g.MakeMatrix("#000000")
+
+		case "ENDSPLIT":
+			if splitSide == nil {
+				return nil, fmt.Errorf("line %d: ENDSPLIT without SPLIT", lineNum)
+			}
+			currentMatrix = composeSplit(*splitSide, currentMatrix, splitDirection)
+			splitSide = nil
+
+		case "SUNRISE":
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("line %d: SUNRISE requires frames", lineNum)
+			}
+			steps, err := strconv.Atoi(parts[1])
+			if err != nil || steps < 2 {
+				return nil, fmt.Errorf("line %d: invalid frame count: %s (must be at least 2)", lineNum, parts[1])
+			}
+			currentMatrix, err = script.generateFrames(lineNum, cmd, steps, func(step int) ColorMatrix {
+				return sunriseFrame(step, steps, g)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+		case "SPIN":
+			if len(parts) < 3 {
+				return nil, fmt.Errorf("line %d: SPIN requires steps degreesPerStep", lineNum)
+			}
+			steps, err := strconv.Atoi(parts[1])
+			if err != nil || steps < 1 {
+				return nil, fmt.Errorf("line %d: invalid step count: %s", lineNum, parts[1])
+			}
+			degrees, err := strconv.ParseFloat(parts[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid degrees", lineNum)
+			}
+			// Each step rotates the original frame, so rounding errors
+			// don't accumulate
+			original := currentMatrix
+			currentMatrix, err = script.generateFrames(lineNum, cmd, steps, func(step int) ColorMatrix {
+				return original.Rotate(degrees * float64(step))
+			})
+			if err != nil {
+				return nil, err
+			}
+
+		case "EXPR":
+			if len(parts) < 3 {
+				return nil, fmt.Errorf("line %d: EXPR requires frameVar target=expression", lineNum)
+			}
+			frameVar := strings.ToLower(parts[1])
+			if frameVar == "x" || frameVar == "y" {
+				return nil, fmt.Errorf("line %d: frame variable must not be x or y", lineNum)
+			}
+			assignment := strings.SplitN(strings.Join(parts[2:], " "), "=", 2)
+			target := strings.ToLower(strings.TrimSpace(assignment[0]))
+			if len(assignment) != 2 || (target != "hue" && target != "bright") {
+				return nil, fmt.Errorf("line %d: EXPR requires hue=<expression> or bright=<expression>", lineNum)
+			}
+			expr, err := parseExpr(assignment[1], "x", "y", frameVar)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			drawExpr(&currentMatrix, target, expr, frameVar, len(script.Frames))
+
+		case "NUMBER":
+			if len(parts) < 3 {
+				return nil, fmt.Errorf("line %d: NUMBER requires n color", lineNum)
+			}
+			n, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number: %s", lineNum, parts[1])
+			}
+			color, err := parseColor(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			if err := drawNumber(&currentMatrix, n, color); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+
+		case "TEXT":
+			text, args, err := parseTextArgs(strings.TrimSpace(line[len(parts[0]):]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			if text == "" || len(args) < 1 {
+				return nil, fmt.Errorf("line %d: TEXT requires \"text\" color [fallback]", lineNum)
+			}
+			color, err := parseColor(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			// Characters missing from the font are blank by default
+			fallback := ' '
+			if len(args) > 1 {
+				runes := []rune(args[1])
+				if _, ok := textGlyph(runes[0]); len(runes) != 1 || !ok {
+					return nil, fmt.Errorf("line %d: invalid fallback character: %s", lineNum, args[1])
+				}
+				fallback = runes[0]
+			}
+			background := currentMatrix
+			count := textFrameCount(text, background.width())
+			currentMatrix, err = script.generateFrames(lineNum, cmd, count, func(step int) ColorMatrix {
+				return textFrame(background, text, color, fallback, step)
+			})
+			if err != nil {
+				return nil, err
+			}
 
 		default:
 			return nil, fmt.Errorf("line %d: unknown command: %s", lineNum, cmd)
 		}
 	}
 
+	if spriteDef != nil {
+		return nil, fmt.Errorf("line %d: SPRITE %s is missing ENDSPRITE", lineNum, spriteName)
+	}
+	if splitSide != nil {
+		return nil, fmt.Errorf("line %d: SPLIT is missing ENDSPLIT", lineNum)
+	}
+	if len(repeats) > 0 {
+		return nil, fmt.Errorf("line %d: REPEAT on line %d is missing ENDREPEAT", lineNum, repeats[len(repeats)-1].line)
+	}
+
 	// Add the last frame if there's content
 	if hasContent {
-		script.Frames = append(script.Frames, currentMatrix)
+		script.addFrame(currentMatrix, background, lineNum)
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading script file: %w", err)
+		return nil, fmt.Errorf("error reading script: %w", err)
 	}
 
 	if len(script.Frames) == 0 {
 		return nil, fmt.Errorf("script file is empty or contains no valid commands")
 	}
 
+	if blankSeparatorLine != 0 && frameSeparatorLine != 0 {
+		script.Warnings = append(script.Warnings, fmt.Sprintf(
+			"line %d: blank line ends a frame, but line %d uses FRAME; use one style of frame separator",
+			blankSeparatorLine, frameSeparatorLine))
+	}
+
 	return script, nil
 }
 
+// maxRepeatDepth is how deeply REPEAT blocks may be nested
+const maxRepeatDepth = 8
+
+// maxScriptFrames limits the frames a script may expand to with REPEAT
+// and the commands generating frames
+const maxScriptFrames = 10000
+
+// checkFrameLimit returns an error when adding count frames would expand
+// the script beyond maxScriptFrames
+func (s *Script) checkFrameLimit(cmd string, count int) error {
+	if count < 0 || count > maxScriptFrames-len(s.Frames) {
+		return fmt.Errorf("%s expands the script beyond %d frames", cmd, maxScriptFrames)
+	}
+	return nil
+}
+
+// generateFrames appends the frames of a command generating count frames,
+// such as SPIN, calling frame for each step. The last one isn't appended
+// but returned, so the following commands draw on it. The limit is
+// checked before any frame is generated.
+func (s *Script) generateFrames(lineNum int, cmd string, count int, frame func(step int) ColorMatrix) (ColorMatrix, error) {
+	if err := s.checkFrameLimit(cmd, count); err != nil {
+		return ColorMatrix{}, fmt.Errorf("line %d: %w", lineNum, err)
+	}
+
+	for step := 0; step < count-1; step++ {
+		s.Frames = append(s.Frames, frame(step))
+	}
+	return frame(count - 1), nil
+}
+
+// repeatBlock is an open REPEAT block: its count, the index of its first
+// frame and the line it started on
+type repeatBlock struct {
+	count int
+	start int
+	line  int
+}
+
+// repeatFrames appends the frames of a closed REPEAT block count-1 more
+// times, so they appear count times in total
+func (s *Script) repeatFrames(block repeatBlock) error {
+	frames := s.Frames[block.start:]
+	if len(frames) == 0 {
+		return nil
+	}
+	if len(frames) > maxScriptFrames/block.count {
+		return fmt.Errorf("REPEAT expands the script beyond %d frames", maxScriptFrames)
+	}
+	if err := s.checkFrameLimit("REPEAT", len(frames)*(block.count-1)); err != nil {
+		return err
+	}
+
+	for n := 1; n < block.count; n++ {
+		for i, frame := range frames {
+			if background, ok := s.Backgrounds[block.start+i]; ok {
+				s.Backgrounds[len(s.Frames)] = background
+			}
+			s.Frames = append(s.Frames, ColorMatrix{
+				Colors:     append([]Color(nil), frame.Colors...),
+				Width:      frame.Width,
+				Brightness: append([]uint8(nil), frame.Brightness...),
+			})
+		}
+	}
+	return nil
+}
+
+// addFrame appends a frame with an optional background color, recording a
+// warning when it is entirely black or identical to the previous frame,
+// which usually means a stray blank line
+func (s *Script) addFrame(frame ColorMatrix, background string, lineNum int) {
+	index := len(s.Frames)
+	if background != "" {
+		s.Backgrounds[index] = background
+	}
+
+	if frame.TotalBrightness() == 0 {
+		s.Warnings = append(s.Warnings, fmt.Sprintf("line %d: frame %d is entirely black", lineNum, index))
+	} else if index > 0 && frame.ToASCII() == s.Frames[index-1].ToASCII() {
+		s.Warnings = append(s.Warnings, fmt.Sprintf("line %d: frame %d is identical to the previous frame", lineNum, index))
+	}
+
+	s.Frames = append(s.Frames, frame)
+}
+
+// Interval returns the frame interval recommended by the script's
+// "# @interval <ms>" header, if present and valid.
+func (s *Script) Interval() (time.Duration, bool) {
+	value, ok := s.Meta["interval"]
+	if !ok {
+		return 0, false
+	}
+
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// IntervalFromScript, given as the interval of RunParsed or RunScript,
+// uses the interval recommended by the script's @interval header, or
+// DefaultInterval without one. An interval of 0 always shows the first
+// frame statically.
+const IntervalFromScript time.Duration = -1
+
+// DefaultInterval is the frame interval of scripts without an @interval
+// header, see IntervalFromScript
+const DefaultInterval = 500 * time.Millisecond
+
 // RunScript executes a script with the given interval and timeout
 func (sr *ScriptRunner) RunScript(scriptName string, interval, timeout time.Duration) error {
-	sr.mu.Lock()
-	if sr.isRunning {
-		sr.mu.Unlock()
-		return fmt.Errorf("a script is already running")
+	script, err := ParseScriptGeometry(scriptName, sr.yeelight.geometry())
+	if err != nil {
+		return err
 	}
-	sr.isRunning = true
-	sr.mu.Unlock()
+	return sr.RunParsed(script, interval, timeout)
+}
 
-	// Parse the script
-	script, err := ParseScript(scriptName)
+// RunScriptWithMode executes a script like RunScript, playing its frames in
+// the given order
+func (sr *ScriptRunner) RunScriptWithMode(scriptName string, interval, timeout time.Duration, mode PlayMode) error {
+	script, err := ParseScriptGeometry(scriptName, sr.yeelight.geometry())
+	if err != nil {
+		return err
+	}
+	script.PlayMode = mode
+	return sr.RunParsed(script, interval, timeout)
+}
+
+// RunScriptReader executes a script read from r, see RunScript
+func (sr *ScriptRunner) RunScriptReader(name string, r io.Reader, interval, timeout time.Duration) error {
+	script, err := ParseScriptReaderGeometry(name, r, sr.yeelight.geometry())
+	if err != nil {
+		return err
+	}
+	return sr.RunParsed(script, interval, timeout)
+}
+
+// RunParsed plays an already parsed or hand-built script with the given
+// interval and timeout, see RunScript. Hand-built scripts must set
+// DirectMode for their frames to be shown. The script must not be modified
+// while it is playing.
+func (sr *ScriptRunner) RunParsed(script *Script, interval, timeout time.Duration) error {
+	if script == nil || len(script.Frames) == 0 {
+		return fmt.Errorf("script has no frames")
+	}
+	for index, frame := range script.Frames {
+		if leds := sr.yeelight.ledCount(); len(frame.Colors) != leds {
+			return fmt.Errorf("frame %d has %d LEDs, the lamp has %d", index, len(frame.Colors), leds)
+		}
+	}
+
+	// An explicit interval, including 0, wins over the script's header
+	if interval == IntervalFromScript {
+		interval = DefaultInterval
+		if metaInterval, ok := script.Interval(); ok {
+			interval = metaInterval
+		}
+	}
+	if interval < 0 {
+		return fmt.Errorf("invalid interval: %v", interval)
+	}
+
+	ctx, err := sr.reserve()
 	if err != nil {
-		sr.mu.Lock()
-		sr.isRunning = false
-		sr.mu.Unlock()
 		return err
 	}
 
+	sr.mu.Lock()
 	sr.currentScript = script
+	sr.interval = interval
+	sr.mu.Unlock()
+
+	first := script.Frames[newFrameOrder(script.PlayMode, len(script.Frames)).index]
+	if err := sr.prepareLamp(script.Name, script.DirectMode, first); err != nil {
+		sr.abortStart()
+		return err
+	}
+
+	if len(script.Backgrounds) > 0 && !sr.yeelight.Supports("bg_set_rgb") {
+		sr.logger.Event("bg_unsupported", LogFields{"script": script.Name})
+	}
+
+	sr.startMusicMode(script.Name, interval)
+
+	sr.logger.Event("start", LogFields{"script": script.Name, "frames": len(script.Frames), "interval": interval, "timeout": timeout, "mode": script.PlayMode})
+
+	// Run the script
+	go sr.runLoop(ctx, interval, timeout)
+
+	return nil
+}
+
+// reserve marks the runner as running, so no other script can start
+// until the loop finishes or abortStart is called. The returned context is
+// canceled to stop the loop.
+func (sr *ScriptRunner) reserve() (context.Context, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.isRunning {
+		return nil, fmt.Errorf("a script is already running")
+	}
+	sr.isRunning = true
+	sr.interval = 0
+	sr.frameIndex = 0
+	sr.startedAt = sr.clock.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	sr.cancel = cancel
+	sr.done = make(chan struct{})
+
+	return ctx, nil
+}
+
+// abortStart releases the runner after a script failed to start
+func (sr *ScriptRunner) abortStart() {
+	sr.mu.Lock()
+	sr.isRunning = false
+	sr.cancel()
+	close(sr.done)
+	sr.mu.Unlock()
+}
+
+// prepareLamp turns the lamp on and, when directMode is set, switches it to
+// direct mode to enable LED control. A lamp that was off is turned on
+// showing first, the frame played first, see turnOn. If direct mode fails
+// on a lamp that was off, the lamp is turned back off; when its previous
+// state is unknown a lamp_left_on event is logged.
+func (sr *ScriptRunner) prepareLamp(scriptName string, directMode bool, first ColorMatrix) error {
+	properties, err := sr.yeelight.GetPropertiesMap([]string{"power", "bright"})
+	powerKnown := err == nil
+	wasOn := powerKnown && properties["power"] == "on"
 
 	// Enable the lamp
-	if err := sr.yeelight.SetOn(Options{Smooth: 200}); err != nil {
-		sr.mu.Lock()
-		sr.isRunning = false
-		sr.mu.Unlock()
-		return fmt.Errorf("failed to turn on lamp: %w", err)
+	if !wasOn {
+		if err := sr.turnOn(first, properties["bright"]); err != nil {
+			return fmt.Errorf("failed to turn on lamp: %w", err)
+		}
+	}
+
+	if !directMode {
+		return nil
 	}
 
-	// Switch to direct mode to enable LED control
 	if err := sr.yeelight.SetDirectMode(); err != nil {
-		sr.mu.Lock()
-		sr.isRunning = false
-		sr.mu.Unlock()
+		switch {
+		case !powerKnown:
+			sr.logger.Event("lamp_left_on", LogFields{"script": scriptName})
+		case !wasOn:
+			if offErr := sr.yeelight.SetOff(DefaultOptions); offErr != nil {
+				sr.logger.Event("lamp_left_on", LogFields{"script": scriptName, "error": offErr})
+			}
+		}
 		return fmt.Errorf("failed to set direct mode: %w", err)
 	}
 
-	// Run the script
-	go sr.runLoop(interval, timeout)
-
 	return nil
 }
 
-// StopScript stops the currently running script
+// turnOn powers the lamp on with the dominant color of frame at its
+// current brightness, in a single set_scene command, so it doesn't flash
+// its previous color before the first frame arrives. Frames without a
+// color, or an unknown brightness, use a regular set_power.
+func (sr *ScriptRunner) turnOn(frame ColorMatrix, bright string) error {
+	color := frame.DominantColor()
+	level, err := strconv.Atoi(bright)
+	if color.Value == 0 || err != nil || level < 1 || level > 100 {
+		return sr.yeelight.SetOn(DefaultOptions)
+	}
+	return sr.yeelight.SetColorBright("#"+color.ToHex(), level)
+}
+
+// StopScript stops the currently running script and waits until its loop
+// has finished, so another script can be started right away
 func (sr *ScriptRunner) StopScript() error {
+	return sr.StopAndWait(context.Background())
+}
+
+// StopAndWait stops the currently running script and blocks until the
+// loop has finished its cleanup, including turning the lamp off, or the
+// context expires
+func (sr *ScriptRunner) StopAndWait(ctx context.Context) error {
 	sr.mu.Lock()
 	if !sr.isRunning {
 		sr.mu.Unlock()
 		return fmt.Errorf("no script is running")
 	}
+	cancel := sr.cancel
+	done := sr.done
 	sr.mu.Unlock()
 
-	// Signal stop
-	sr.stopChan <- true
+	// Canceling doesn't block, even if the loop is already exiting on its
+	// own
+	cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShowFrame pushes a single frame of the script to the lamp and leaves it
+// displayed. Unlike RunScript it doesn't start the animation loop: the
+// runner is only held while the frame is sent, and the lamp is not turned
+// off afterwards.
+func (sr *ScriptRunner) ShowFrame(script *Script, index int) error {
+	if index < 0 || index >= len(script.Frames) {
+		return fmt.Errorf("frame %d out of range (script has %d frames)", index, len(script.Frames))
+	}
+
+	// A script started meanwhile would fight over the lamp
+	if _, err := sr.reserve(); err != nil {
+		return err
+	}
+	defer sr.abortStart()
+
+	if err := sr.yeelight.EnsureOn(DefaultOptions); err != nil {
+		return fmt.Errorf("failed to turn on lamp: %w", err)
+	}
+
+	// Scripts that only set the ambient light leave the matrix alone
+	if script.DirectMode {
+		if err := sr.yeelight.SetDirectMode(); err != nil {
+			return fmt.Errorf("failed to set direct mode: %w", err)
+		}
+
+		if err := sr.yeelight.SetMatrix([]ColorMatrix{script.Frames[index]}); err != nil {
+			return err
+		}
+
+		sr.mu.Lock()
+		sr.lastDisplayed = script.Frames[index]
+		sr.mu.Unlock()
+	}
 
-	// Wait for the loop to finish
-	time.Sleep(100 * time.Millisecond)
+	if background, ok := script.Backgrounds[index]; ok && sr.yeelight.Supports("bg_set_rgb") {
+		return sr.yeelight.BgSetHexColor(background, DefaultOptions)
+	}
 
 	return nil
 }
 
 // runLoop is the main animation loop
-func (sr *ScriptRunner) runLoop(interval, timeout time.Duration) {
+func (sr *ScriptRunner) runLoop(ctx context.Context, interval, timeout time.Duration) {
 	defer func() {
-		sr.mu.Lock()
-		sr.isRunning = false
-		sr.mu.Unlock()
+		sr.finish(recover())
 	}()
 
 	var timeoutChan <-chan time.Time
 	if timeout > 0 {
-		timeoutChan = time.After(timeout)
+		timeoutChan = sr.clock.After(timeout)
 	}
 
-	// Always turn off the lamp when the loop ends
-	defer func() {
-		sr.yeelight.SetOff(Options{Smooth: 200})
-	}()
+	// Turn off the lamp when the loop ends, unless asked to keep the frame
+	defer sr.leaveLamp()
+
+	scriptName := sr.currentScript.Name
+	sr.resetDisplay()
 
-	// If interval is 0, display static (first frame only)
+	order := newFrameOrder(sr.currentScript.PlayMode, len(sr.currentScript.Frames))
+	frameIndex := order.index
+
+	// If interval is 0, display static (first frame in play order only)
 	if interval == 0 {
-		matrices := []ColorMatrix{sr.currentScript.Frames[0]}
-		if err := sr.yeelight.SetMatrix(matrices); err != nil {
-			fmt.Printf("Error setting matrix: %v\n", err)
-		}
+		sr.display(sr.currentScript, frameIndex)
 
 		// Wait for stop signal or timeout
 		select {
-		case <-sr.stopChan:
+		case <-ctx.Done():
+			sr.logger.Event("stop", LogFields{"script": scriptName})
 			return
 		case <-timeoutChan:
+			sr.logger.Event("timeout", LogFields{"script": scriptName})
 			return
 		}
 	}
 
 	// Animation loop
-	frameIndex := 0
-	ticker := time.NewTicker(interval)
+	ticker := sr.clock.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		// Display current frame
-		matrices := []ColorMatrix{sr.currentScript.Frames[frameIndex]}
-		if err := sr.yeelight.SetMatrix(matrices); err != nil {
-			fmt.Printf("Error setting matrix: %v\n", err)
-		}
+		sr.display(sr.currentScript, frameIndex)
 
 		// Move to next frame
-		frameIndex = (frameIndex + 1) % len(sr.currentScript.Frames)
+		frameIndex = order.next()
 
 		// Wait for next frame, stop signal, or timeout
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			continue
-		case <-sr.stopChan:
+		case <-ctx.Done():
+			sr.logger.Event("stop", LogFields{"script": scriptName})
 			return
 		case <-timeoutChan:
+			sr.logger.Event("timeout", LogFields{"script": scriptName})
 			return
 		}
 	}
 }
 
+// finish marks the runner as stopped when a loop exits. A panic recovered
+// from the loop is logged and reported to OnStop instead of crashing the
+// process; the loop's deferred leaveLamp still turns the lamp off.
+func (sr *ScriptRunner) finish(recovered interface{}) {
+	var err error
+	if recovered != nil {
+		err = fmt.Errorf("script panicked: %v", recovered)
+		sr.logger.Event("panic", LogFields{"error": recovered})
+	}
+
+	sr.mu.Lock()
+	sr.isRunning = false
+	sr.cancel()
+	close(sr.done)
+	onStop := sr.OnStop
+	sr.mu.Unlock()
+
+	if onStop != nil {
+		onStop(err)
+	}
+}
+
+// leaveLamp turns the lamp off when a loop ends, or leaves the last frame
+// displayed if KeepLastFrame is set, and ends music mode started for the
+// script
+func (sr *ScriptRunner) leaveLamp() {
+	sr.mu.Lock()
+	keep := sr.KeepLastFrame
+	sr.mu.Unlock()
+
+	if !keep {
+		sr.yeelight.SetOff(DefaultOptions)
+	}
+	sr.stopMusicMode()
+}
+
+// startMusicMode enables music mode for fast animations, see
+// MusicModeInterval. Without it the script still plays, limited by the
+// command quota.
+func (sr *ScriptRunner) startMusicMode(scriptName string, interval time.Duration) {
+	sr.mu.Lock()
+	threshold := sr.MusicModeInterval
+	sr.mu.Unlock()
+	if threshold == 0 {
+		threshold = DefaultMusicModeInterval
+	}
+
+	if interval <= 0 || interval >= threshold || sr.yeelight.MusicModeState() != MusicModeOff {
+		return
+	}
+
+	if err := sr.yeelight.EnableMusicMode(""); err != nil {
+		sr.logger.Event("music_mode_error", LogFields{"script": scriptName, "error": err})
+		return
+	}
+
+	sr.mu.Lock()
+	sr.musicMode = true
+	sr.mu.Unlock()
+	sr.logger.Event("music_mode", LogFields{"script": scriptName})
+}
+
+// stopMusicMode disables music mode if the runner enabled it
+func (sr *ScriptRunner) stopMusicMode() {
+	sr.mu.Lock()
+	enabled := sr.musicMode
+	sr.musicMode = false
+	sr.mu.Unlock()
+
+	if enabled {
+		sr.yeelight.DisableMusicMode()
+	}
+}
+
+// resetDisplay forgets the previously displayed frame when a loop starts,
+// which also starts the uptime reported by Status
+func (sr *ScriptRunner) resetDisplay() {
+	sr.mu.Lock()
+	sr.lastDisplayed = ColorMatrix{}
+	sr.lastPowerCheck = sr.clock.Now()
+	sr.startedAt = sr.clock.Now()
+	sr.mu.Unlock()
+}
+
+// checkPower turns the lamp back on in direct mode if it was switched off
+// since the last check, see PowerCheckInterval. Direct mode is only
+// restored when directMode is set.
+func (sr *ScriptRunner) checkPower(scriptName string, directMode bool) {
+	sr.mu.Lock()
+	interval := sr.PowerCheckInterval
+	due := interval > 0 && sr.clock.Now().Sub(sr.lastPowerCheck) >= interval
+	if due {
+		sr.lastPowerCheck = sr.clock.Now()
+	}
+	sr.mu.Unlock()
+
+	if !due {
+		return
+	}
+
+	on, err := sr.yeelight.IsOn()
+	if err != nil || on {
+		return
+	}
+
+	sr.logger.Event("power_restore", LogFields{"script": scriptName})
+	if err := sr.yeelight.SetOn(DefaultOptions); err != nil {
+		sr.logger.Event("power_restore_error", LogFields{"script": scriptName, "error": err})
+		return
+	}
+	if !directMode {
+		return
+	}
+	if err := sr.yeelight.SetDirectMode(); err != nil {
+		sr.logger.Event("power_restore_error", LogFields{"script": scriptName, "error": err})
+	}
+}
+
+// LastFrame returns a copy of the most recently displayed frame, after the
+// afterimage effect, so it can be re-sent after a reconnect. ok is false
+// when nothing has been displayed since the last script started.
+func (sr *ScriptRunner) LastFrame() (frame ColorMatrix, ok bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if len(sr.lastDisplayed.Colors) == 0 {
+		return ColorMatrix{}, false
+	}
+
+	// Width and Brightness are kept, the slices are copied so the caller
+	// can't change the runner's frame
+	frame = sr.lastDisplayed
+	frame.Colors = append([]Color(nil), frame.Colors...)
+	frame.Brightness = append([]uint8(nil), frame.Brightness...)
+	return frame, true
+}
+
+// display sends a frame to the lamp, applying the afterimage effect, and
+// logs a frame_error event on failure
+func (sr *ScriptRunner) display(script *Script, frameIndex int) {
+	frame := script.Frames[frameIndex]
+	sr.checkPower(script.Name, script.DirectMode)
+
+	sr.mu.Lock()
+	sr.frameIndex = frameIndex
+	if script.DirectMode {
+		if sr.Afterimage > 0 && len(sr.lastDisplayed.Colors) == len(frame.Colors) {
+			frame = blendAfterimage(frame, sr.lastDisplayed, math.Min(sr.Afterimage, 1))
+		}
+		sr.lastDisplayed = frame
+	}
+	sr.mu.Unlock()
+
+	// Scripts that only set the ambient light leave the matrix alone
+	if script.DirectMode {
+		if err := sr.yeelight.SetMatrix([]ColorMatrix{frame}); err != nil {
+			sr.logger.Event("frame_error", LogFields{"script": script.Name, "frame": frameIndex, "error": err})
+		}
+	}
+
+	// Set the ambient light alongside the matrix when the frame has a BG
+	if background, ok := script.Backgrounds[frameIndex]; ok && sr.yeelight.Supports("bg_set_rgb") {
+		if err := sr.yeelight.BgSetHexColor(background, DefaultOptions); err != nil {
+			sr.logger.Event("frame_error", LogFields{"script": script.Name, "frame": frameIndex, "error": err})
+		}
+	}
+}
+
 // Helper functions
 
+// fadeFrame returns frame step (0 to steps) of a transition from one frame
+// to target over steps frames: the starting frame, the eased intermediate
+// frames, and target itself
+func fadeFrame(from, target ColorMatrix, step, steps int, easing Easing) ColorMatrix {
+	switch step {
+	case 0:
+		return from
+	case steps:
+		return target
+	}
+	return blendMatrix(from, target, easing.Apply(float64(step)/float64(steps)))
+}
+
+// composeSplit combines two frames: with direction V the left columns come
+// from a and the right ones from b, with H the top rows from a and the
+// bottom ones from b. The center column or row belongs to a.
+func composeSplit(a, b ColorMatrix, direction string) ColorMatrix {
+	composed := ColorMatrix{Colors: append([]Color(nil), b.Colors...), Width: b.Width, Brightness: append([]uint8(nil), b.Brightness...)}
+	width, rows := a.width(), a.rows()
+	if direction == "V" {
+		composed.Paste(a.SubMatrix(0, 0, (width-1)/2, rows-1), 0, 0)
+	} else {
+		composed.Paste(a.SubMatrix(0, 0, width-1, (rows-1)/2), 0, 0)
+	}
+	return composed
+}
+
+// sunriseFrame returns frame step of a sunrise over steps frames: the
+// panel goes from off through deep red and warm orange to bright warm
+// white, with the bottom rows leading the top ones
+func sunriseFrame(step, steps int, g Geometry) ColorMatrix {
+	t := float64(step) / float64(steps-1)
+	frame := g.MakeMatrix("#000000")
+	for row := 0; row < g.Rows; row++ {
+		// Each row above the bottom one lags behind by an eighth
+		rowT := math.Max(0, math.Min(1, t*1.5-float64(g.Rows-1-row)*0.125))
+		color := sunriseColor(rowT)
+		for column := 0; column < g.Cols; column++ {
+			frame.SetColor(Vector{Row: row, Column: column}, color)
+		}
+	}
+	return frame
+}
+
+// sunriseColor returns the sunrise color at progress t (0.0-1.0)
+func sunriseColor(t float64) Color {
+	// Deep red rising into orange, then warming up to 3000K white
+	if t < 0.6 {
+		u := t / 0.6
+		return MakeColorHSV(30*u, 1, 0.8*u)
+	}
+
+	u := (t - 0.6) / 0.4
+	orange := ColorMatrix{Colors: []Color{MakeColorHSV(30, 1, 0.8)}}
+	white := ColorMatrix{Colors: []Color{CTtoRGB(3000)}}
+	return blendMatrix(orange, white, u).Colors[0]
+}
+
+// blendMatrix linearly interpolates every displayed pixel, with the per-LED
+// brightness applied, from a to b by t (0.0-1.0)
+func blendMatrix(a, b ColorMatrix, t float64) ColorMatrix {
+	a, b = a.Flatten(), b.Flatten()
+	blended := ColorMatrix{Colors: make([]Color, len(a.Colors)), Width: a.Width}
+	for i := range a.Colors {
+		r1, g1, b1 := a.Colors[i].ToRGB()
+		r2, g2, b2 := b.Colors[i].ToRGB()
+		r := int64(math.Round(float64(r1) + (float64(r2)-float64(r1))*t))
+		g := int64(math.Round(float64(g1) + (float64(g2)-float64(g1))*t))
+		bl := int64(math.Round(float64(b1) + (float64(b2)-float64(b1))*t))
+		blended.Colors[i] = Color{Value: r<<16 | g<<8 | bl}
+	}
+	return blended
+}
+
+// blendAfterimage returns the frame composited over the previous frame
+// decayed by factor, keeping the brighter value of each displayed channel
+func blendAfterimage(frame, previous ColorMatrix, decay float64) ColorMatrix {
+	frame, previous = frame.Flatten(), previous.Flatten()
+	blended := ColorMatrix{Colors: make([]Color, len(frame.Colors)), Width: frame.Width}
+	for i := range frame.Colors {
+		r1, g1, b1 := frame.Colors[i].ToRGB()
+		r2, g2, b2 := previous.Colors[i].ToRGB()
+		r := math.Max(float64(r1), float64(r2)*decay)
+		g := math.Max(float64(g1), float64(g2)*decay)
+		b := math.Max(float64(b1), float64(b2)*decay)
+		blended.Colors[i] = Color{Value: int64(r)<<16 | int64(g)<<8 | int64(b)}
+	}
+	return blended
+}
+
+// parseTextArgs splits the arguments of TEXT into the text, which may be
+// quoted to include spaces, and the remaining arguments
+func parseTextArgs(args string) (string, []string, error) {
+	if !strings.HasPrefix(args, "\"") {
+		fields := strings.Fields(args)
+		if len(fields) == 0 {
+			return "", nil, nil
+		}
+		return fields[0], fields[1:], nil
+	}
+
+	end := strings.Index(args[1:], "\"")
+	if end < 0 {
+		return "", nil, fmt.Errorf("unterminated quote in text: %s", args)
+	}
+	return args[1 : end+1], strings.Fields(args[end+2:]), nil
+}
+
 func parseColor(colorStr string) (string, error) {
 	colorStr = strings.ToLower(colorStr)
 
@@ -439,23 +1522,73 @@ func parseColor(colorStr string) (string, error) {
 	return "", fmt.Errorf("unknown color: %s", colorStr)
 }
 
-func parseCoordinates(xStr, yStr string) (int, int, error) {
-	x, err := strconv.Atoi(xStr)
-	if err != nil || x < 0 || x > 4 {
-		return 0, 0, fmt.Errorf("invalid x coordinate: %s", xStr)
+// parseMetaLine parses a "# @key value" header line
+func parseMetaLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+	if !strings.HasPrefix(line, "@") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(line, "@"), " ", 2)
+	key := strings.ToLower(strings.TrimSpace(parts[0]))
+	if key == "" {
+		return "", "", false
 	}
 
-	y, err := strconv.Atoi(yStr)
-	if err != nil || y < 0 || y > 4 {
-		return 0, 0, fmt.Errorf("invalid y coordinate: %s", yStr)
+	value := ""
+	if len(parts) > 1 {
+		value = strings.TrimSpace(parts[1])
 	}
 
-	return x, y, nil
+	return key, value, true
+}
+
+func parseKelvin(kelvinStr string) (int, error) {
+	kelvin, err := strconv.Atoi(kelvinStr)
+	if err != nil || kelvin < 1700 || kelvin > 6500 {
+		return 0, fmt.Errorf("invalid color temperature: %s (must be 1700-6500)", kelvinStr)
+	}
+	return kelvin, nil
+}
+
+func drawCTGradient(matrix *ColorMatrix, direction string, kelvinA, kelvinB int) {
+	width, rows := matrix.width(), matrix.rows()
+	for y := 0; y < rows; y++ {
+		for x := 0; x < width; x++ {
+			pos, last := x, width-1
+			if direction == "V" {
+				pos, last = y, rows-1
+			}
+			kelvin := kelvinA
+			if last > 0 {
+				kelvin += (kelvinB - kelvinA) * pos / last
+			}
+			matrix.SetColor(Vector{Row: y, Column: x}, CTtoRGB(kelvin))
+		}
+	}
+}
+
+// drawGradient fills the matrix with colors interpolated in RGB from color1
+// at x1,y1 to color2 at x2,y2, by each pixel's projection onto the line
+// between them. Pixels beyond an endpoint take its color.
+func drawGradient(matrix *ColorMatrix, x1, y1 int, color1 Color, x2, y2 int, color2 Color) {
+	from := ColorMatrix{Colors: []Color{color1}}
+	to := ColorMatrix{Colors: []Color{color2}}
+
+	dx, dy := float64(x2-x1), float64(y2-y1)
+	length := dx*dx + dy*dy
+	for y := 0; y < matrix.rows(); y++ {
+		for x := 0; x < matrix.width(); x++ {
+			t := (float64(x-x1)*dx + float64(y-y1)*dy) / length
+			t = math.Max(0, math.Min(1, t))
+			matrix.SetColor(Vector{Row: y, Column: x}, blendMatrix(from, to, t).Colors[0])
+		}
+	}
 }
 
 func drawCircle(matrix *ColorMatrix, cx, cy, radius int, color string) {
-	for y := 0; y < 5; y++ {
-		for x := 0; x < 5; x++ {
+	for y := 0; y < matrix.rows(); y++ {
+		for x := 0; x < matrix.width(); x++ {
 			dx := x - cx
 			dy := y - cy
 			distance := math.Sqrt(float64(dx*dx + dy*dy))
@@ -467,8 +1600,8 @@ func drawCircle(matrix *ColorMatrix, cx, cy, radius int, color string) {
 }
 
 func drawRing(matrix *ColorMatrix, cx, cy, radius int, color string) {
-	for y := 0; y < 5; y++ {
-		for x := 0; x < 5; x++ {
+	for y := 0; y < matrix.rows(); y++ {
+		for x := 0; x < matrix.width(); x++ {
 			dx := x - cx
 			dy := y - cy
 			distance := math.Sqrt(float64(dx*dx + dy*dy))
@@ -479,10 +1612,11 @@ func drawRing(matrix *ColorMatrix, cx, cy, radius int, color string) {
 	}
 }
 
-func drawRect(matrix *ColorMatrix, x1, y1, x2, y2 int, color string) {
-	for y := y1; y <= y2 && y < 5; y++ {
-		for x := x1; x <= x2 && x < 5; x++ {
-			if x >= 0 && y >= 0 {
+func drawRect(matrix *ColorMatrix, x1, y1, x2, y2 int, color string, filled bool) {
+	for y := y1; y <= y2 && y < matrix.rows(); y++ {
+		for x := x1; x <= x2 && x < matrix.width(); x++ {
+			border := x == x1 || x == x2 || y == y1 || y == y2
+			if x >= 0 && y >= 0 && (filled || border) {
 				matrix.SetHex(Vector{Row: y, Column: x}, color)
 			}
 		}
@@ -504,7 +1638,7 @@ func drawLine(matrix *ColorMatrix, x1, y1, x2, y2 int, color string) {
 	err := dx - dy
 
 	for {
-		if x1 >= 0 && x1 < 5 && y1 >= 0 && y1 < 5 {
+		if matrix.contains(Vector{Row: y1, Column: x1}) {
 			matrix.SetHex(Vector{Row: y1, Column: x1}, color)
 		}
 
@@ -528,7 +1662,7 @@ func drawCross(matrix *ColorMatrix, cx, cy, size int, color string) {
 	// Horizontal line
 	for i := -size; i <= size; i++ {
 		x := cx + i
-		if x >= 0 && x < 5 {
+		if matrix.contains(Vector{Row: cy, Column: x}) {
 			matrix.SetHex(Vector{Row: cy, Column: x}, color)
 		}
 	}
@@ -536,42 +1670,37 @@ func drawCross(matrix *ColorMatrix, cx, cy, size int, color string) {
 	// Vertical line
 	for i := -size; i <= size; i++ {
 		y := cy + i
-		if y >= 0 && y < 5 {
+		if matrix.contains(Vector{Row: y, Column: cx}) {
 			matrix.SetHex(Vector{Row: y, Column: cx}, color)
 		}
 	}
 }
 
 func shiftMatrix(matrix ColorMatrix, direction string) ColorMatrix {
-	newMatrix := MakeMatrix("#000000", 25)
+	newMatrix := ColorMatrix{Colors: make([]Color, len(matrix.Colors)), Width: matrix.Width}
 
+	dx, dy := 0, 0
 	switch direction {
 	case "UP":
-		for y := 0; y < 4; y++ {
-			for x := 0; x < 5; x++ {
-				color := matrix.GetColor(Vector{Row: y + 1, Column: x})
-				newMatrix.SetColor(Vector{Row: y, Column: x}, color)
-			}
-		}
+		dy = 1
 	case "DOWN":
-		for y := 1; y < 5; y++ {
-			for x := 0; x < 5; x++ {
-				color := matrix.GetColor(Vector{Row: y - 1, Column: x})
-				newMatrix.SetColor(Vector{Row: y, Column: x}, color)
-			}
-		}
+		dy = -1
 	case "LEFT":
-		for y := 0; y < 5; y++ {
-			for x := 0; x < 4; x++ {
-				color := matrix.GetColor(Vector{Row: y, Column: x + 1})
-				newMatrix.SetColor(Vector{Row: y, Column: x}, color)
-			}
-		}
+		dx = 1
 	case "RIGHT":
-		for y := 0; y < 5; y++ {
-			for x := 1; x < 5; x++ {
-				color := matrix.GetColor(Vector{Row: y, Column: x - 1})
-				newMatrix.SetColor(Vector{Row: y, Column: x}, color)
+		dx = -1
+	}
+
+	// Each pixel takes the color of its neighbor on the opposite side,
+	// pixels shifted in from the edge are black
+	for y := 0; y < matrix.rows(); y++ {
+		for x := 0; x < matrix.width(); x++ {
+			from := Vector{Row: y + dy, Column: x + dx}
+			if matrix.contains(from) {
+				newMatrix.SetColor(Vector{Row: y, Column: x}, matrix.GetColor(from))
+				if len(matrix.Brightness) > 0 {
+					newMatrix.SetBrightness(Vector{Row: y, Column: x}, matrix.GetBrightness(from))
+				}
 			}
 		}
 	}
@@ -579,19 +1708,55 @@ func shiftMatrix(matrix ColorMatrix, direction string) ColorMatrix {
 	return newMatrix
 }
 
+// dimMatrix scales the brightness of every LED by factor, keeping colors
 func dimMatrix(matrix *ColorMatrix, factor float64) {
-	for i := range matrix.Colors {
-		r, g, b := matrix.Colors[i].ToRGB()
+	brightness := make([]uint8, len(matrix.Colors))
+	for i := range brightness {
+		brightness[i] = uint8(math.Round(float64(matrix.brightness(i)) * factor))
+	}
+	matrix.Brightness = brightness
+}
+
+// tintMatrix multiplies every pixel by the tint color's normalized channels
+func tintMatrix(matrix *ColorMatrix, tint Color) {
+	tr, tg, tb := tint.ToRGB()
+	matrix.ApplyFunc(func(v Vector, c Color) Color {
+		r, g, b := c.ToRGB()
+		r = byte(int(r) * int(tr) / 255)
+		g = byte(int(g) * int(tg) / 255)
+		b = byte(int(b) * int(tb) / 255)
+		return Color{Value: int64(r)<<16 | int64(g)<<8 | int64(b)}
+	})
+}
+
+// invertValueMatrix replaces each pixel's HSV value V with 1-V, keeping
+// hue and saturation. Black pixels have no hue and stay black.
+func invertValueMatrix(matrix *ColorMatrix) {
+	matrix.ApplyFunc(func(v Vector, c Color) Color {
+		if c.Value == 0 {
+			return c
+		}
+		h, s, value := c.ToHSV()
+		return MakeColorHSV(h, s, 1-value)
+	})
+}
+
+// vignetteMatrix scales each pixel's brightness by a factor interpolated
+// from centerFactor at the center to edgeFactor at the corners
+func vignetteMatrix(matrix *ColorMatrix, centerFactor, edgeFactor float64) {
+	// Distances are relative to the corners, 0 at the center
+	cx, cy := float64(matrix.width()-1)/2, float64(matrix.rows()-1)/2
+	maxDistance := math.Max(math.Sqrt(cx*cx+cy*cy), 1)
+	matrix.ApplyFunc(func(v Vector, c Color) Color {
+		dx := float64(v.Column) - cx
+		dy := float64(v.Row) - cy
+		distance := math.Sqrt(dx*dx+dy*dy) / maxDistance
+		factor := centerFactor + (edgeFactor-centerFactor)*distance
+
+		r, g, b := c.ToRGB()
 		r = byte(float64(r) * factor)
 		g = byte(float64(g) * factor)
 		b = byte(float64(b) * factor)
-		matrix.Colors[i].RGB(int8(r), int8(g), int8(b))
-	}
+		return Color{Value: int64(r)<<16 | int64(g)<<8 | int64(b)}
+	})
 }
-
-func abs(n int) int {
-	if n < 0 {
-		return -n
-	}
-	return n
-}
\ No newline at end of file
@@ -0,0 +1,416 @@
+package yeelight
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeScript writes a script to a temporary file and returns its path
+func writeScript(t *testing.T, source string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(filename, []byte(source), 0o644); err != nil {
+		t.Fatalf("failed to write the script: %v", err)
+	}
+	return filename
+}
+
+// mustParse parses a script given as a string, failing the test on errors
+func mustParse(t *testing.T, source string) *Script {
+	t.Helper()
+	script, err := ParseScriptReader("test", strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", source, err)
+	}
+	return script
+}
+
+// pixel returns the displayed color at column x, row y as "#rrggbb"
+func pixel(matrix ColorMatrix, x, y int) string {
+	return matrix.ToHexSlice()[matrix.index(Vector{Row: y, Column: x})]
+}
+
+// parseError parses a script that must fail and returns the error message
+func parseError(t *testing.T, source string) string {
+	t.Helper()
+	_, err := ParseScriptReader("test", strings.NewReader(source))
+	if err == nil {
+		t.Fatalf("expected %q to fail", source)
+	}
+	return err.Error()
+}
+
+func TestGeneratedFramesAreLimited(t *testing.T) {
+	long := strings.Repeat("A", 3000)
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"FILL red\nSPIN 100000000 1\n", "line 2: SPIN expands the script beyond 10000 frames"},
+		{"FILL red\nFADE 100000000 blue\n", "line 2: FADE expands the script beyond 10000 frames"},
+		{"FADE 9223372036854775807 blue\n", "line 1: FADE expands the script beyond 10000 frames"},
+		{"SUNRISE 100000000\n", "line 1: SUNRISE expands the script beyond 10000 frames"},
+		{"CLEAR\nTEXT \"" + long + "\" red\n", "line 2: TEXT expands the script beyond 10000 frames"},
+		{"REPEAT 100000000\nFILL red\nENDREPEAT\n", "line 3: REPEAT expands the script beyond 10000 frames"},
+	}
+
+	for _, test := range tests {
+		if got := parseError(t, test.source); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestTint(t *testing.T) {
+	script := mustParse(t, "FILL white\nPIXEL 0 0 black\nTINT red\n")
+	frame := script.Frames[0]
+
+	if got := pixel(frame, 2, 2); got != "#ff0000" {
+		t.Errorf("tinted white is %s, want #ff0000", got)
+	}
+	if got := pixel(frame, 0, 0); got != "#000000" {
+		t.Errorf("tinted black is %s, want #000000", got)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunnerFollowsFakeClock(t *testing.T) {
+	runner, lamp, clock := newTestRunner(t)
+	lamp.reply("get_prop", `"result":["on","50"]`)
+
+	if err := runner.RunScript(writeScript(t, "FILL red\n\nFILL green\n\nFILL blue\n"), time.Second, 10*time.Second); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	running := func() bool {
+		runner.mu.Lock()
+		defer runner.mu.Unlock()
+		return runner.isRunning
+	}
+	sent := func(n int) func() bool {
+		return func() bool { return countMethod(lamp.methods(), "update_leds") == n }
+	}
+
+	// The timeout and the frame ticker
+	waitFor(t, "the loop to wait on the clock", func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		return len(clock.waiters) == 2
+	})
+	waitFor(t, "the first frame", sent(1))
+
+	clock.Advance(time.Second)
+	waitFor(t, "the second frame", sent(2))
+	clock.Advance(time.Second)
+	waitFor(t, "the third frame", sent(3))
+	if !running() {
+		t.Fatal("stopped before the timeout")
+	}
+
+	powered := countMethod(lamp.methods(), "set_power")
+	clock.Advance(8 * time.Second)
+	waitFor(t, "the timeout", func() bool { return !running() })
+	if got := countMethod(lamp.methods(), "set_power") - powered; got != 1 {
+		t.Errorf("sent set_power %d times after the timeout, want 1 to turn the lamp off", got)
+	}
+}
+
+func TestCoordinateErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"PIXEL a 0 red\n", `line 1: x coordinate must be a whole number, got "a"`},
+		{"PIXEL -1 0 red\n", "line 1: x coordinate must not be negative, got -1 (allowed 0-4)"},
+		{"PIXEL 5 0 red\n", "line 1: x coordinate 5 is out of range (allowed 0-4)"},
+		{"PIXEL 0 1.5 red\n", `line 1: y coordinate must be a whole number, got "1.5"`},
+		{"PIXEL 0 -2 red\n", "line 1: y coordinate must not be negative, got -2 (allowed 0-4)"},
+		{"PIXEL 0 9 red\n", "line 1: y coordinate 9 is out of range (allowed 0-4)"},
+		{"ROW top red\n", `line 1: row must be a whole number, got "top"`},
+		{"ROW -1 red\n", "line 1: row must not be negative, got -1 (allowed 0-4)"},
+		{"ROW 5 red\n", "line 1: row 5 is out of range (allowed 0-4)"},
+		{"COL x red\n", `line 1: column must be a whole number, got "x"`},
+		{"COL -3 red\n", "line 1: column must not be negative, got -3 (allowed 0-4)"},
+		{"FILL red\nCOL 7 red\n", "line 2: column 7 is out of range (allowed 0-4)"},
+	}
+
+	for _, test := range tests {
+		if got := parseError(t, test.source); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestInvertValue(t *testing.T) {
+	script := mustParse(t, "FILL #400000\nPIXEL 0 0 black\nPIXEL 1 0 #00ff00\nPIXEL 2 0 #202040\nINVERTV\n")
+	frame := script.Frames[0]
+
+	// The hue and saturation stay, the value v becomes 1-v
+	for x, want := range map[int]string{0: "#000000", 1: "#000000", 2: "#6060bf", 3: "#bf0000"} {
+		if got := pixel(frame, x, 0); got != want {
+			t.Errorf("pixel %d is %s, want %s", x, got, want)
+		}
+	}
+}
+
+func TestGradient(t *testing.T) {
+	script := mustParse(t, "GRADIENT 0 0 red 4 0 blue\n")
+	frame := script.Frames[0]
+
+	for y := 0; y < 5; y++ {
+		if got := pixel(frame, 0, y); got != "#ff0000" {
+			t.Errorf("left end of row %d is %s, want red", y, got)
+		}
+		if got := pixel(frame, 4, y); got != "#0000ff" {
+			t.Errorf("right end of row %d is %s, want blue", y, got)
+		}
+	}
+
+	// The midpoint mixes both ends about equally
+	mid := frame.GetColor(Vector{Row: 2, Column: 2})
+	r, g, b := mid.ToRGB()
+	if g != 0 || r < 120 || r > 135 || b < 120 || b > 135 {
+		t.Errorf("midpoint is %d,%d,%d, want about 128,0,128", r, g, b)
+	}
+
+	if got := parseError(t, "GRADIENT 1 1 red 1 1 blue\n"); got != "line 1: GRADIENT endpoints must differ" {
+		t.Errorf("same endpoints: got %q", got)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+
+func TestRunnerRestartsRepeatedly(t *testing.T) {
+	runner, lamp, clock := newTestRunner(t)
+	lamp.reply("get_prop", `"result":["on","50"]`)
+	script := mustParse(t, "FILL red\n\nFILL blue\n")
+
+	const runs = 50
+	for i := 0; i < runs; i++ {
+		if err := runner.RunParsed(script, 100*time.Millisecond, 0); err != nil {
+			t.Fatalf("run %d: failed to start: %v", i, err)
+		}
+		clock.Advance(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := runner.StopAndWait(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("run %d: failed to stop: %v", i, err)
+		}
+		runner.mu.Lock()
+		running := runner.isRunning
+		runner.mu.Unlock()
+		if running {
+			t.Fatalf("run %d: still running after stop", i)
+		}
+	}
+
+	// Every run turns the lamp off when it stops
+	if got := countMethod(lamp.methods(), "set_power"); got != runs {
+		t.Errorf("sent set_power %d times, want %d", got, runs)
+	}
+}
+
+func TestDirectModeFollowsCommands(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"BG red\n", false},
+		{"BG red\n\nBG blue\n", false},
+		{"FILL red\n", true},
+		{"BG red\nPIXEL 0 0 blue\n", true},
+		{"BG red\n\nCLEAR\n", true},
+	}
+
+	for _, test := range tests {
+		if got := mustParse(t, test.source).DirectMode; got != test.want {
+			t.Errorf("%q: DirectMode is %v, want %v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestRunnerDirectMode(t *testing.T) {
+	tests := []struct {
+		source string
+		direct bool
+	}{
+		{"BG red\n", false},
+		{"FILL red\n", true},
+	}
+
+	for _, test := range tests {
+		runner, lamp, _ := newTestRunner(t)
+		if err := runner.RunParsed(mustParse(t, test.source), 0, 0); err != nil {
+			t.Fatalf("%q: failed to start: %v", test.source, err)
+		}
+		if err := runner.StopScript(); err != nil {
+			t.Fatalf("%q: failed to stop: %v", test.source, err)
+		}
+
+		methods := lamp.methods()
+		wantMatrix := 0
+		if test.direct {
+			wantMatrix = 1
+		}
+		if got := countMethod(methods, "activate_fx_mode"); got != wantMatrix {
+			t.Errorf("%q: sent activate_fx_mode %d times, want %d (%v)", test.source, got, wantMatrix, methods)
+		}
+		if got := countMethod(methods, "update_leds"); got != wantMatrix {
+			t.Errorf("%q: sent update_leds %d times, want %d (%v)", test.source, got, wantMatrix, methods)
+		}
+	}
+}
+
+func TestExplicitIntervalWinsOverHeader(t *testing.T) {
+	withHeader := "# @interval 250\nFILL red\n\nFILL blue\n"
+	tests := []struct {
+		source   string
+		interval time.Duration
+		want     time.Duration
+	}{
+		{withHeader, IntervalFromScript, 250 * time.Millisecond},
+		{withHeader, 0, 0},
+		{withHeader, time.Second, time.Second},
+		{"FILL red\n", IntervalFromScript, DefaultInterval},
+	}
+
+	for _, test := range tests {
+		runner, _, _ := newTestRunner(t)
+		if err := runner.RunParsed(mustParse(t, test.source), test.interval, 0); err != nil {
+			t.Fatalf("failed to start with %v: %v", test.interval, err)
+		}
+		got := runner.Status().IntervalMs
+		runner.StopScript()
+		if want := test.want.Milliseconds(); got != want {
+			t.Errorf("%q with %v: playing at %dms, want %dms", test.source, test.interval, got, want)
+		}
+	}
+}
+
+func TestRunnerTurnsOnWithFirstFrame(t *testing.T) {
+	runner, lamp, _ := newTestRunner(t)
+	lamp.reply("get_prop", `"result":["off","40"]`)
+
+	if err := runner.RunParsed(mustParse(t, "FILL #00ff00\nPIXEL 0 0 red\n"), 0, 0); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	runner.StopScript()
+
+	commands := lamp.received()
+	if len(commands) < 2 || commands[1].Method != "set_scene" {
+		t.Fatalf("sent %v, want set_scene after get_prop", lamp.methods())
+	}
+	if countMethod(lamp.methods(), "set_power") != 1 {
+		t.Errorf("sent %v, want set_power only to turn the lamp off at the end", lamp.methods())
+	}
+
+	// The dominant color at the brightness the lamp had
+	params, ok := commands[1].Params.([]interface{})
+	if !ok || len(params) != 3 || params[0] != "color" || params[1] != float64(0x00FF00) || params[2] != float64(40) {
+		t.Errorf("set_scene params %v, want [color 65280 40]", commands[1].Params)
+	}
+}
+
+func TestRunnerTurnsOnWithoutColor(t *testing.T) {
+	runner, lamp, _ := newTestRunner(t)
+	lamp.reply("get_prop", `"result":["off","40"]`)
+
+	if err := runner.RunParsed(mustParse(t, "CLEAR\n"), 0, 0); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	runner.StopScript()
+
+	methods := lamp.methods()
+	if countMethod(methods, "set_scene") != 0 || len(methods) < 2 || methods[1] != "set_power" {
+		t.Errorf("sent %v, want set_power after get_prop for a black frame", methods)
+	}
+}
+
+func TestLastFrameIsAFullCopy(t *testing.T) {
+	runner, _, _ := newTestRunner(t)
+	runner.yeelight.Geometry = Geometry{Rows: 1, Cols: 25}
+	script, err := ParseScriptReaderGeometry("test", strings.NewReader("FILL red\n"), runner.yeelight.Geometry)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	script.Frames[0].Brightness = make([]uint8, 25)
+	script.Frames[0].Brightness[3] = 40
+
+	if _, ok := runner.LastFrame(); ok {
+		t.Fatal("got a last frame before anything was displayed")
+	}
+	if err := runner.RunParsed(script, 0, 0); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer runner.StopScript()
+
+	var frame ColorMatrix
+	waitFor(t, "the frame to be displayed", func() bool {
+		var ok bool
+		frame, ok = runner.LastFrame()
+		return ok
+	})
+	if frame.Width != 25 || len(frame.Colors) != 25 || len(frame.Brightness) != 25 || frame.Brightness[3] != 40 {
+		t.Fatalf("got width %d, %d colors and brightness %v", frame.Width, len(frame.Colors), frame.Brightness)
+	}
+
+	frame.Colors[0] = Color{}
+	frame.Brightness[3] = 0
+	again, _ := runner.LastFrame()
+	if again.Colors[0].Value != 0xFF0000 || again.Brightness[3] != 40 {
+		t.Error("changing the returned frame changed the runner's frame")
+	}
+}
+
+func TestDimmedFramesKeepTheirBrightness(t *testing.T) {
+	shifted := mustParse(t, "FILL #ff0000\nDIM 0.5\nSHIFT LEFT\n").Frames[0]
+	if got := pixel(shifted, 0, 0); got != "#800000" {
+		t.Errorf("shifted pixel is %s, want the dimmed #800000", got)
+	}
+	if got := pixel(shifted, 4, 0); got != "#000000" {
+		t.Errorf("shifted in pixel is %s, want #000000", got)
+	}
+
+	// The fade starts from the dimmed red the lamp showed
+	faded := mustParse(t, "FILL #ff0000\nDIM 0.5\nFADE 2 #ff0000\n").Frames
+	if got := pixel(faded[len(faded)-2], 2, 2); got != "#c00000" {
+		t.Errorf("fade midpoint is %s, want #c00000", got)
+	}
+}
+
+func TestShowFrameHoldsTheRunner(t *testing.T) {
+	runner, lamp, _ := newTestRunner(t)
+	lamp.reply("get_prop", `"result":["on","50"]`)
+	script := mustParse(t, "FILL red\n\nFILL blue\n")
+
+	if err := runner.ShowFrame(script, 1); err != nil {
+		t.Fatalf("ShowFrame failed: %v", err)
+	}
+	if runner.IsRunning() {
+		t.Fatal("the runner is still held after showing the frame")
+	}
+
+	if err := runner.RunParsed(script, time.Second, 0); err != nil {
+		t.Fatalf("failed to start after a preview: %v", err)
+	}
+	defer runner.StopScript()
+	if err := runner.ShowFrame(script, 0); err == nil {
+		t.Error("ShowFrame succeeded while a script is running")
+	}
+}
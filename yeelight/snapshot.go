@@ -0,0 +1,105 @@
+package yeelight
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Snapshot is a saved lamp state that can be reapplied with
+// RestoreSnapshot.
+type Snapshot struct {
+	Power  bool `json:"power"`
+	Bright int  `json:"bright"`
+	// ColorMode is 1 for RGB, 2 for color temperature and 3 for HSV
+	ColorMode int `json:"color_mode"`
+	RGB       int `json:"rgb"`
+	CT        int `json:"ct"`
+	Hue       int `json:"hue"`
+	Sat       int `json:"sat"`
+}
+
+// snapshotProperties are the properties read by SaveSnapshot
+var snapshotProperties = []string{"power", "bright", "color_mode", "rgb", "ct", "hue", "sat"}
+
+// SaveSnapshot reads the current state of the lamp and keeps it in memory
+// under name, replacing an earlier snapshot of the same name.
+func (yl *Yeelight) SaveSnapshot(name string) (Snapshot, error) {
+	properties, err := yl.GetPropertiesMap(snapshotProperties)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{Power: properties["power"] == "on"}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"bright", &snapshot.Bright},
+		{"color_mode", &snapshot.ColorMode},
+		{"rgb", &snapshot.RGB},
+		{"ct", &snapshot.CT},
+		{"hue", &snapshot.Hue},
+		{"sat", &snapshot.Sat},
+	} {
+		// Properties a model doesn't have are empty and stay 0
+		if properties[field.name] == "" {
+			continue
+		}
+		value, err := strconv.Atoi(properties[field.name])
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("%w: %s is %q", ErrInvalidResponse, field.name, properties[field.name])
+		}
+		*field.value = value
+	}
+
+	yl.stateMu.Lock()
+	if yl.snapshots == nil {
+		yl.snapshots = map[string]Snapshot{}
+	}
+	yl.snapshots[name] = snapshot
+	yl.stateMu.Unlock()
+
+	return snapshot, nil
+}
+
+// RestoreSnapshot reapplies a state saved by SaveSnapshot: the lamp is
+// turned on first, then its color or color temperature and finally its
+// brightness are set. A snapshot of a lamp that was off just turns it off.
+func (yl *Yeelight) RestoreSnapshot(name string) error {
+	yl.stateMu.Lock()
+	snapshot, ok := yl.snapshots[name]
+	yl.stateMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSnapshot, name)
+	}
+
+	if !snapshot.Power {
+		return yl.SetOff(DefaultOptions)
+	}
+
+	if err := yl.SetOn(DefaultOptions); err != nil {
+		return err
+	}
+
+	effect, duration := DefaultOptions.effect()
+	var err error
+	switch snapshot.ColorMode {
+	case 1:
+		if snapshot.RGB > 0 {
+			_, err = yl.SendCommand(Command{Method: "set_rgb", Params: []interface{}{snapshot.RGB, effect, duration}})
+		}
+	case 2:
+		err = yl.SetColorTemperature(int16(snapshot.CT), DefaultOptions)
+	case 3:
+		_, err = yl.SendCommand(Command{Method: "set_hsv", Params: []interface{}{snapshot.Hue, snapshot.Sat, effect, duration}})
+	}
+	if err != nil {
+		return err
+	}
+
+	if snapshot.Bright >= 1 && snapshot.Bright <= 100 {
+		return yl.SetBright(int8(snapshot.Bright), DefaultOptions)
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package yeelight
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sprite is a small named bitmap defined with SPRITE ... ENDSPRITE. Each
+// cell holds a hex color, or "" for a transparent pixel.
+type sprite struct {
+	rows [][]string
+}
+
+// parseSpriteRow parses a sprite row of space separated cells, where each
+// cell is a color or "." for a transparent pixel
+func parseSpriteRow(line string) ([]string, error) {
+	cells := strings.Fields(line)
+	if len(cells) > 5 {
+		return nil, fmt.Errorf("sprite row has %d pixels, at most 5 allowed", len(cells))
+	}
+
+	row := make([]string, len(cells))
+	for i, cell := range cells {
+		if cell == "." {
+			continue
+		}
+		color, err := parseColor(cell)
+		if err != nil {
+			return nil, err
+		}
+		row[i] = color
+	}
+
+	return row, nil
+}
+
+// stampSprite composites the sprite onto the matrix with its top left corner
+// at x, y. Pixels falling outside the grid are clipped.
+func stampSprite(matrix *ColorMatrix, s sprite, x, y int) {
+	for dy, row := range s.rows {
+		for dx, color := range row {
+			v := Vector{Row: y + dy, Column: x + dx}
+			if color == "" || !matrix.contains(v) {
+				continue
+			}
+			matrix.SetHex(v, color)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package yeelight
+
+import "time"
+
+// RunnerStatus describes what a ScriptRunner is playing, see Status.
+type RunnerStatus struct {
+	Running bool `json:"running"`
+	// Script is the name of the current script or built-in, empty when
+	// nothing is running
+	Script string `json:"script"`
+	// IntervalMs is the frame interval in milliseconds, 0 for a static
+	// frame
+	IntervalMs int64 `json:"interval_ms"`
+	// Frame is the index of the frame on display, Frames the number of
+	// frames of the current script
+	Frame  int `json:"frame"`
+	Frames int `json:"frames"`
+	// UptimeS is the number of whole seconds since the script started
+	UptimeS int64 `json:"uptime_s"`
+}
+
+// Status returns what the runner is playing. It only holds the runner's
+// lock briefly, so polling it doesn't slow down the animation.
+func (sr *ScriptRunner) Status() RunnerStatus {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if !sr.isRunning {
+		return RunnerStatus{}
+	}
+
+	status := RunnerStatus{
+		Running:    true,
+		IntervalMs: int64(sr.interval / time.Millisecond),
+		Frame:      sr.frameIndex,
+		UptimeS:    int64(sr.clock.Now().Sub(sr.startedAt) / time.Second),
+	}
+	if sr.currentScript != nil {
+		status.Script = sr.currentScript.Name
+		status.Frames = len(sr.currentScript.Frames)
+	}
+	return status
+}
+
+// IsRunning reports whether a script, playlist or built-in is playing.
+func (sr *ScriptRunner) IsRunning() bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	return sr.isRunning
+}
+
+// CurrentScriptName returns the name of the script playing, empty when
+// nothing is running.
+func (sr *ScriptRunner) CurrentScriptName() string {
+	return sr.Status().Script
+}
+
+// CurrentFrame returns the index of the frame on display within the
+// current script, 0 when nothing is running.
+func (sr *ScriptRunner) CurrentFrame() int {
+	return sr.Status().Frame
+}
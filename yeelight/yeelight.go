@@ -3,22 +3,185 @@ package yeelight
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrQuotaExceeded is returned when the lamp rejects a command because the
+// client exceeded its command quota (roughly 60 commands per minute outside
+// of music mode, which has no quota).
+var ErrQuotaExceeded = errors.New("client quota exceeded: the lamp accepts about 60 commands per minute, increase the animation interval or use music mode (EnableMusicMode, or ScriptRunner.MusicModeInterval for scripts)")
+
+// ErrLANControlDisabled is returned by Probe when the lamp accepts the TCP
+// connection but doesn't answer commands.
+var ErrLANControlDisabled = errors.New("lamp does not respond to commands: enable LAN Control for this device in the Yeelight app")
+
+// ErrTimeout is returned when the lamp doesn't answer a command in time.
+var ErrTimeout = errors.New("timeout waiting for response")
+
+// ErrInvalidResponse is returned when the lamp's response can't be
+// interpreted.
+var ErrInvalidResponse = errors.New("invalid response")
+
+// ErrUnsupported is returned when the lamp doesn't support a feature.
+var ErrUnsupported = errors.New("operation not supported by this lamp")
+
+// ErrNoSnapshot is returned by RestoreSnapshot for an unknown name.
+var ErrNoSnapshot = errors.New("snapshot not found")
+
+// ErrBlackColor is returned when black is set as the whole lamp color.
+// Lamps reject an RGB value of 0, use SetOff or a minimal brightness
+// instead. Matrix frames sent by SetMatrix may contain black LEDs.
+var ErrBlackColor = errors.New("black is not a valid lamp color, turn the lamp off instead")
+
 type Yeelight struct {
-	YLID            int32         `json:"id"`
-	Address         string        `json:"address"`
-	Persistent      bool          `json:"persistent",default0:"false"`
-	Conn            net.Conn      `json:"-"`
+	YLID            int32    `json:"id"`
+	Address         string   `json:"address"`
+	Persistent      bool     `json:"persistent" default0:"false"`
+	Conn            net.Conn `json:"-"`
 	ConnectTimeout  time.Duration
 	ResponseTimeout time.Duration
+	// DeviceID, Model and Name are reported by the lamp during discovery,
+	// see Discover
+	DeviceID string `json:"device_id,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Name     string `json:"name,omitempty"`
+	// Support lists the methods the lamp supports, as reported by the
+	// "support" header during discovery. Empty means unknown.
+	Support []string `json:"support,omitempty"`
+	// TimeoutRetries is how many times a command is resent over a fresh
+	// connection when the lamp doesn't answer in time. 0 uses the default
+	// of 1, a negative value disables retries. Methods that change the lamp
+	// relatively, such as toggle or set_adjust, are never resent.
+	TimeoutRetries int
+	// MaxTotalBrightness caps the summed perceived brightness of a frame
+	// sent by SetMatrix. Each LED contributes 0.0 (black) to 1.0 (white),
+	// so a full white 5x5 frame totals 25. Frames above the limit are
+	// scaled down proportionally. 0 disables the guard. Around 12-15 is
+	// a safe value for long full-brightness animations.
+	MaxTotalBrightness float64
+	// OnNotification, if set, receives "props" notifications the lamp
+	// sends while a command response is being awaited.
+	OnNotification func(Notification) `json:"-"`
+	// CTMin and CTMax limit the color temperatures accepted by
+	// SetColorTemperature, in Kelvin. The lamp doesn't report its range, so
+	// set them for models that differ from the defaults. 0 uses
+	// DefaultCTMin and DefaultCTMax.
+	CTMin int
+	CTMax int
+	// Gamma is applied by SetMatrix with GammaCorrect so midtones look
+	// right on the LEDs. 0 or 1 disables the correction, 2.2 is typical.
+	Gamma float64
+	// LEDCount is the number of LEDs of one matrix module. SetASCII
+	// expects a single module, SetMatrix one module per matrix it is
+	// given. 0 means the LEDs of Geometry.
+	LEDCount int
+	// Geometry is the layout of the LEDs, used to parse scripts for the
+	// lamp and to check pixel positions. Zero means DefaultGeometry.
+	Geometry Geometry
+	// Pool, if set, sends commands over a connection shared through the
+	// pool instead of dialing per command, see ConnPool.
+	Pool *ConnPool `json:"-"`
+
+	// stateMu guards the client side state below
+	stateMu sync.Mutex
+	// lastMatrix is the last single frame sent by SetMatrix, the base
+	// SetPixels applies its changes to
+	lastMatrix ColorMatrix
+	// snapshots are the states saved by SaveSnapshot, by name
+	snapshots map[string]Snapshot
+
+	// music is the music mode connection, see EnableMusicMode
+	music musicState
+
+	// connMu serializes commands over the connection kept in Conn when
+	// Persistent is set, connReader buffers its responses
+	connMu     sync.Mutex
+	connReader *bufio.Reader
+}
+
+// DefaultLEDCount is the number of LEDs of a single 5x5 matrix module.
+const DefaultLEDCount = 25
+
+// asciiCharsPerLED is the length of one LED color in an update_leds payload.
+const asciiCharsPerLED = 4
+
+// Color temperature range supported by most Yeelight models, in Kelvin.
+const (
+	DefaultCTMin = 1700
+	DefaultCTMax = 6500
+)
+
+// ClientConfig groups the connection settings of a Yeelight client. Zero
+// fields fall back to their defaults.
+type ClientConfig struct {
+	// Persistent keeps the TCP connection open between commands, dialing
+	// again only after the lamp closed it. Default: false.
+	Persistent bool
+	// ConnectTimeout limits dialing the lamp. Default: 3s.
+	ConnectTimeout time.Duration
+	// ResponseTimeout limits waiting for a command response. Default: 500ms.
+	ResponseTimeout time.Duration
+	// TimeoutRetries is how many times a timed out command is resent.
+	// Default: 1, a negative value disables retries.
+	TimeoutRetries int
+	// MaxTotalBrightness caps the summed brightness of matrix frames, see
+	// Yeelight.MaxTotalBrightness. Default: 0 (disabled).
+	MaxTotalBrightness float64
+	// Gamma corrects matrix frames, see Yeelight.Gamma. Default: 0
+	// (disabled).
+	Gamma float64
+	// Pool shares connections between clients, see Yeelight.Pool.
+	// Default: nil (dial per command).
+	Pool *ConnPool
+	// Geometry is the LED layout of the lamp, see Yeelight.Geometry.
+	// Default: DefaultGeometry (5x5).
+	Geometry Geometry
+}
+
+// DefaultClientConfig returns the configuration used for zero fields.
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		ConnectTimeout:  3 * time.Second,
+		ResponseTimeout: 500 * time.Millisecond,
+		TimeoutRetries:  1,
+	}
+}
+
+// NewYeelight creates a client for the lamp at address ("host:port").
+// A zero-value Yeelight{Address: ...} keeps working and uses the same
+// defaults.
+func NewYeelight(address string, cfg ClientConfig) *Yeelight {
+	defaults := DefaultClientConfig()
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if cfg.ResponseTimeout == 0 {
+		cfg.ResponseTimeout = defaults.ResponseTimeout
+	}
+	if cfg.TimeoutRetries == 0 {
+		cfg.TimeoutRetries = defaults.TimeoutRetries
+	}
+
+	return &Yeelight{
+		Address:            address,
+		Persistent:         cfg.Persistent,
+		ConnectTimeout:     cfg.ConnectTimeout,
+		ResponseTimeout:    cfg.ResponseTimeout,
+		TimeoutRetries:     cfg.TimeoutRetries,
+		MaxTotalBrightness: cfg.MaxTotalBrightness,
+		Gamma:              cfg.Gamma,
+		Pool:               cfg.Pool,
+		Geometry:           cfg.Geometry,
+	}
 }
 
 type Command struct {
@@ -33,8 +196,34 @@ type Response struct {
 	Error  interface{} `json:"error,omitempty"`
 }
 
+// Notification is an unsolicited state change message sent by the lamp.
+type Notification struct {
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// Options controls the transition of a state change.
 type Options struct {
+	// Smooth is the transition duration in milliseconds. Zero means
+	// DefaultOptions.Smooth, a 0ms smooth transition is rejected by some
+	// firmwares.
 	Smooth int `default0:"200"`
+	// Sudden applies the change immediately, ignoring Smooth.
+	Sudden bool
+}
+
+// DefaultOptions is used for the fields left unset in Options.
+var DefaultOptions = Options{Smooth: 200}
+
+// effect returns the effect and duration parameters sent to the lamp.
+func (o Options) effect() (string, int) {
+	if o.Sudden {
+		return "sudden", 0
+	}
+	if o.Smooth <= 0 {
+		return "smooth", DefaultOptions.Smooth
+	}
+	return "smooth", o.Smooth
 }
 
 type FxMode struct {
@@ -47,6 +236,16 @@ type Color struct {
 
 type ColorMatrix struct {
 	Colors []Color
+	// Width is the number of columns, 0 means the 5 columns of the Cube's
+	// matrix. Matrices made by Geometry.MakeMatrix and regions returned by
+	// SubMatrix set it.
+	Width int
+	// Brightness is the brightness of each LED, 0-255, applied to its
+	// color when the matrix is encoded. nil or missing entries mean full
+	// brightness. Rotate, SubMatrix and Paste carry it along with the
+	// colors, Histogram, DominantColor and Diff look at the colors with
+	// it applied.
+	Brightness []uint8
 }
 
 type Vector struct {
@@ -80,10 +279,12 @@ const (
 	CfActionOff     CfAction = 2 // Turn off the light
 )
 
+// Index returns the position of the LED in a 5x5 matrix.
+//
+// Deprecated: Index assumes 5 columns. Use Geometry.Index, which follows
+// the lamp's layout.
 func (v *Vector) Index() int {
-	r := v.Column
-	r += (v.Row * 5)
-	return r
+	return DefaultGeometry.Index(*v)
 }
 
 func MakeMatrix(hex string, size int) ColorMatrix {
@@ -95,10 +296,10 @@ func MakeMatrix(hex string, size int) ColorMatrix {
 	return colorMatrix
 }
 
+// MakeSpotMatrix returns a black 5x5 matrix with the top left LED set to
+// hex, see Geometry.MakeSpotMatrix.
 func MakeSpotMatrix(hex string) ColorMatrix {
-	colorMatrix := MakeMatrix("#000000", 5)
-	colorMatrix.SetHex(Vector{0, 0}, hex)
-	return colorMatrix
+	return DefaultGeometry.MakeSpotMatrix(hex)
 }
 
 func MakeFromHexColors(matrix []string) ColorMatrix {
@@ -110,22 +311,99 @@ func MakeFromHexColors(matrix []string) ColorMatrix {
 	return colorMatrix
 }
 
+// MatrixFromArt builds a 5x5 matrix from string art, see
+// Geometry.MatrixFromArt.
+func MatrixFromArt(art string, palette map[rune]string) (ColorMatrix, error) {
+	return DefaultGeometry.MatrixFromArt(art, palette)
+}
+
+// RenderBars renders up to 5 values as bars on a 5x5 matrix, see
+// Geometry.RenderBars.
+func RenderBars(values []float64, colors []string) ColorMatrix {
+	return DefaultGeometry.RenderBars(values, colors)
+}
+
 func (matrix *ColorMatrix) ToASCII() string {
 	ascii := ""
-	for _, element := range matrix.Colors {
+	for index, element := range matrix.Colors {
+		element = element.scaled(matrix.brightness(index))
 		ascii += element.ToASCII()
 	}
 
 	return ascii
 }
 
+// SetBrightness sets the brightness of a single LED, 0 (off) to 255 (full),
+// keeping its color.
+func (matrix *ColorMatrix) SetBrightness(v Vector, level uint8) {
+	if len(matrix.Brightness) < len(matrix.Colors) {
+		brightness := make([]uint8, len(matrix.Colors))
+		for index := range brightness {
+			brightness[index] = matrix.brightness(index)
+		}
+		matrix.Brightness = brightness
+	}
+	matrix.Brightness[matrix.index(v)] = level
+}
+
+// GetBrightness returns the brightness of a single LED, see SetBrightness.
+func (matrix *ColorMatrix) GetBrightness(v Vector) uint8 {
+	return matrix.brightness(matrix.index(v))
+}
+
+// brightness returns the brightness of the LED at index, 255 when unset
+func (matrix *ColorMatrix) brightness(index int) uint8 {
+	if index < len(matrix.Brightness) {
+		return matrix.Brightness[index]
+	}
+	return 255
+}
+
+// Flatten returns a copy of the matrix with the per-LED brightness applied
+// to the colors and Brightness cleared, i.e. the colors the lamp shows.
+func (matrix *ColorMatrix) Flatten() ColorMatrix {
+	flat := ColorMatrix{Colors: make([]Color, len(matrix.Colors)), Width: matrix.Width}
+	for index, element := range matrix.Colors {
+		flat.Colors[index] = element.scaled(matrix.brightness(index))
+	}
+	return flat
+}
+
+// Diff returns the pixels whose displayed color, with the per-LED
+// brightness applied, differs in other, with their displayed color in
+// other. Both matrices are expected to have the same size; pixels present
+// in only one of them are ignored.
+func (matrix *ColorMatrix) Diff(other ColorMatrix) map[Vector]Color {
+	width := matrix.width()
+	changes := map[Vector]Color{}
+	for index := 0; index < len(matrix.Colors) && index < len(other.Colors); index++ {
+		shown := other.Colors[index].scaled(other.brightness(index))
+		if matrix.Colors[index].scaled(matrix.brightness(index)).Value != shown.Value {
+			changes[Vector{Row: index / width, Column: index % width}] = shown
+		}
+	}
+
+	return changes
+}
+
+// ToHexSlice returns the colors as "#rrggbb" strings, row by row.
+func (matrix *ColorMatrix) ToHexSlice() []string {
+	hexes := make([]string, len(matrix.Colors))
+	for index, element := range matrix.Colors {
+		element = element.scaled(matrix.brightness(index))
+		hexes[index] = "#" + element.ToHex()
+	}
+
+	return hexes
+}
+
 func (matrix *ColorMatrix) ReplaceAllHex(h string) {
 	for index := range matrix.Colors {
 		matrix.Colors[index].Hex(h)
 	}
 }
 
-func (matrix *ColorMatrix) ReplaceAllRGB(r int8, g int8, b int8) {
+func (matrix *ColorMatrix) ReplaceAllRGB(r uint8, g uint8, b uint8) {
 	for index, element := range matrix.Colors {
 		element.RGB(r, g, b)
 		matrix.Colors[index] = element
@@ -133,57 +411,272 @@ func (matrix *ColorMatrix) ReplaceAllRGB(r int8, g int8, b int8) {
 }
 
 func (matrix *ColorMatrix) SetHex(v Vector, h string) {
-	matrix.Colors[v.Index()].Hex(h)
+	matrix.Colors[matrix.index(v)].Hex(h)
 }
 
 func (matrix *ColorMatrix) SetColor(v Vector, c Color) {
-	matrix.Colors[v.Index()] = c
+	matrix.Colors[matrix.index(v)] = c
 }
 
 func (matrix *ColorMatrix) GetColor(v Vector) Color {
-	return matrix.Colors[v.Index()]
+	return matrix.Colors[matrix.index(v)]
+}
+
+func (matrix *ColorMatrix) SetRGB(v Vector, r uint8, g uint8, b uint8) {
+	matrix.Colors[matrix.index(v)].RGB(r, g, b)
+}
+
+// ApplyFunc replaces every pixel with the color returned by f, which is
+// called with the pixel's position and current color. Positions are derived
+// from the pixel index using the matrix width.
+func (matrix *ColorMatrix) ApplyFunc(f func(v Vector, c Color) Color) {
+	width := matrix.width()
+	for index, element := range matrix.Colors {
+		v := Vector{Row: index / width, Column: index % width}
+		matrix.Colors[index] = f(v, element)
+	}
+}
+
+// Histogram returns how many pixels show each distinct color, keyed by hex.
+// The per-LED brightness is applied to the colors.
+func (matrix *ColorMatrix) Histogram() map[string]int {
+	histogram := map[string]int{}
+	for index, element := range matrix.Colors {
+		element = element.scaled(matrix.brightness(index))
+		histogram[element.ToHex()]++
+	}
+	return histogram
+}
+
+// DominantColor returns the most common displayed color of the matrix, see
+// Histogram. Ties go to the color that appears first.
+func (matrix *ColorMatrix) DominantColor() Color {
+	histogram := matrix.Histogram()
+
+	var dominant Color
+	best := 0
+	for index, element := range matrix.Colors {
+		element = element.scaled(matrix.brightness(index))
+		if count := histogram[element.ToHex()]; count > best {
+			dominant = element
+			best = count
+		}
+	}
+
+	return dominant
+}
+
+// width returns the number of columns of the matrix
+func (matrix *ColorMatrix) width() int {
+	if matrix.Width > 0 {
+		return matrix.Width
+	}
+	return 5
+}
+
+// rows returns the number of rows of the matrix
+func (matrix *ColorMatrix) rows() int {
+	return len(matrix.Colors) / matrix.width()
+}
+
+// contains reports whether v lies within the matrix
+func (matrix *ColorMatrix) contains(v Vector) bool {
+	return v.Row >= 0 && v.Row < matrix.rows() && v.Column >= 0 && v.Column < matrix.width()
+}
+
+// index returns the position of v in Colors, see Vector.Index
+func (matrix *ColorMatrix) index(v Vector) int {
+	return v.Row*matrix.width() + v.Column
+}
+
+// SubMatrix returns a copy of the rectangular region between columns x1-x2
+// and rows y1-y2 (inclusive), clipped to the matrix. Its Width is set to
+// the region width, use Paste to place it back.
+func (matrix *ColorMatrix) SubMatrix(x1, y1, x2, y2 int) ColorMatrix {
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+	if y1 > y2 {
+		y1, y2 = y2, y1
+	}
+
+	width := matrix.width()
+	rows := len(matrix.Colors) / width
+	x1, y1 = max(x1, 0), max(y1, 0)
+	x2, y2 = min(x2, width-1), min(y2, rows-1)
+	if x1 > x2 || y1 > y2 {
+		return ColorMatrix{}
+	}
+
+	region := ColorMatrix{Width: x2 - x1 + 1}
+	for y := y1; y <= y2; y++ {
+		region.Colors = append(region.Colors, matrix.Colors[y*width+x1:y*width+x2+1]...)
+		if len(matrix.Brightness) > 0 {
+			for x := x1; x <= x2; x++ {
+				region.Brightness = append(region.Brightness, matrix.brightness(y*width+x))
+			}
+		}
+	}
+
+	return region
+}
+
+// Paste copies src onto the matrix with its top left corner at column x
+// and row y, along with its per-LED brightness. Pixels falling outside the
+// matrix are clipped.
+func (matrix *ColorMatrix) Paste(src ColorMatrix, x, y int) {
+	width := matrix.width()
+	rows := len(matrix.Colors) / width
+	srcWidth := src.width()
+	brightness := len(src.Brightness) > 0 || len(matrix.Brightness) > 0
+
+	for index, element := range src.Colors {
+		column := x + index%srcWidth
+		row := y + index/srcWidth
+		if column >= 0 && column < width && row >= 0 && row < rows {
+			matrix.Colors[row*width+column] = element
+			if brightness {
+				matrix.SetBrightness(Vector{Row: row, Column: column}, src.brightness(index))
+			}
+		}
+	}
+}
+
+// GammaCorrect applies out = 255*(in/255)^gamma to every channel, which
+// darkens the midtones that LEDs otherwise show too bright.
+func (matrix *ColorMatrix) GammaCorrect(gamma float64) {
+	correct := func(channel byte) int64 {
+		return int64(math.Round(255 * math.Pow(float64(channel)/255, gamma)))
+	}
+
+	for index := range matrix.Colors {
+		r, g, b := matrix.Colors[index].ToRGB()
+		matrix.Colors[index] = Color{Value: correct(r)<<16 | correct(g)<<8 | correct(b)}
+	}
+}
+
+// VividPalette is a default palette of saturated colors that look clean on
+// the panel, for use with Quantize.
+var VividPalette = []Color{
+	{Value: 0x000000}, // black
+	{Value: 0xFFFFFF}, // white
+	{Value: 0xFF0000}, // red
+	{Value: 0xFF8000}, // orange
+	{Value: 0xFFFF00}, // yellow
+	{Value: 0x00FF00}, // green
+	{Value: 0x00FFFF}, // cyan
+	{Value: 0x0000FF}, // blue
+	{Value: 0x8000FF}, // purple
+	{Value: 0xFF00FF}, // magenta
 }
 
-func (matrix *ColorMatrix) SetRGB(v Vector, r int8, g int8, b int8) {
-	matrix.Colors[v.Index()].RGB(r, g, b)
+// Quantize snaps every pixel to the nearest palette color by RGB distance,
+// so frames derived from photos don't look muddy. An empty palette uses
+// VividPalette.
+func (matrix *ColorMatrix) Quantize(palette []Color) {
+	if len(palette) == 0 {
+		palette = VividPalette
+	}
+
+	for index := range matrix.Colors {
+		r, g, b := matrix.Colors[index].ToRGB()
+		best := 0
+		bestDistance := -1
+		for i := range palette {
+			pr, pg, pb := palette[i].ToRGB()
+			dr, dg, db := int(r)-int(pr), int(g)-int(pg), int(b)-int(pb)
+			if distance := dr*dr + dg*dg + db*db; bestDistance < 0 || distance < bestDistance {
+				best = i
+				bestDistance = distance
+			}
+		}
+		matrix.Colors[index] = palette[best]
+	}
 }
 
+// Rotate rotates the matrix by angle degrees around its center pixel, see
+// RotateAt.
 func (matrix *ColorMatrix) Rotate(angle float64) ColorMatrix {
-	return matrix.RotateAt(angle, Vector{2, 2})
+	return matrix.RotateAt(angle, Vector{Row: (matrix.rows() - 1) / 2, Column: (matrix.width() - 1) / 2})
 }
 
+// RotateAt rotates the matrix by angle degrees around center. Each pixel
+// of the result samples the source pixel that rotates onto it, so there
+// are no holes at angles other than multiples of 90°; pixels whose source
+// lies outside the grid stay black.
 func (matrix *ColorMatrix) RotateAt(angle float64, center Vector) ColorMatrix {
-	new_matrix := MakeMatrix("#000000", 25)
+	new_matrix := ColorMatrix{Colors: make([]Color, len(matrix.Colors)), Width: matrix.Width}
 	a := float64(angle * math.Pi / 180.0)
 
 	cx := float64(center.Column)
 	cy := float64(center.Row)
 
-	for y := 0.0; y < 5.0; y++ {
-		for x := 0.0; x < 5.0; x++ {
-			x_f_new := cx + ((x-cx)*math.Cos(a) - (y-cy)*math.Sin(a))
-			y_f_new := cy + ((x-cx)*math.Sin(a) + (y-cy)*math.Cos(a))
+	for y := 0.0; y < float64(matrix.rows()); y++ {
+		for x := 0.0; x < float64(matrix.width()); x++ {
+			// Inverse rotation finds the source of the destination pixel
+			x_f_old := cx + ((x-cx)*math.Cos(a) + (y-cy)*math.Sin(a))
+			y_f_old := cy + (-(x-cx)*math.Sin(a) + (y-cy)*math.Cos(a))
 
-			x_new := int(math.Round(math.Abs(x_f_new)))
-			y_new := int(math.Round(math.Abs(y_f_new)))
+			v_old := Vector{Column: int(math.Round(x_f_old)), Row: int(math.Round(y_f_old))}
+			if !matrix.contains(v_old) {
+				continue
+			}
 
-			v_old := Vector{Column: int(x), Row: int(y)}
-			v_new := Vector{Column: x_new, Row: y_new}
+			v_new := Vector{Column: int(x), Row: int(y)}
 
-			color := matrix.GetColor(v_old)
-			new_matrix.SetColor(v_new, color)
+			new_matrix.SetColor(v_new, matrix.GetColor(v_old))
+			if len(matrix.Brightness) > 0 {
+				new_matrix.SetBrightness(v_new, matrix.GetBrightness(v_old))
+			}
 		}
 	}
 
 	return new_matrix
 }
 
-func MakeColorRGB(r int8, g int8, b int8) Color {
+func MakeColorRGB(r uint8, g uint8, b uint8) Color {
 	color := Color{}
 	color.RGB(r, g, b)
 	return color
 }
 
+// MakeColorHSV creates a color from hue (0-360 degrees), saturation and
+// value (0.0-1.0).
+func MakeColorHSV(h, s, v float64) Color {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	s = math.Max(0, math.Min(1, s))
+	v = math.Max(0, math.Min(1, v))
+
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	channel := func(f float64) int64 {
+		return int64(math.Round((f + m) * 255))
+	}
+
+	return Color{Value: channel(r)<<16 | channel(g)<<8 | channel(b)}
+}
+
 func MakeColorHEX(hex string) Color {
 	color := Color{}
 	color.Hex(hex)
@@ -204,10 +697,11 @@ func (color *Color) Hex(hexv string) (err error) {
 	return nil
 }
 
-func (color *Color) RGB(r int8, g int8, b int8) {
-	color.Value = int64(b)
-	color.Value += (int64(r) << 16)
-	color.Value += (int64(g) << 8)
+// RGB sets the color from its red, green and blue channels (0-255).
+func (color *Color) RGB(r uint8, g uint8, b uint8) {
+	color.Value = int64(b) & 0xFF
+	color.Value |= (int64(r) & 0xFF) << 16
+	color.Value |= (int64(g) & 0xFF) << 8
 }
 
 func (color *Color) ToRGB() (r byte, g byte, b byte) {
@@ -217,8 +711,108 @@ func (color *Color) ToRGB() (r byte, g byte, b byte) {
 	return
 }
 
+// scaled returns the color with each channel scaled by level/255
+func (color *Color) scaled(level uint8) Color {
+	if level == 255 {
+		return *color
+	}
+	r, g, b := color.ToRGB()
+	scale := func(channel byte) int64 {
+		return int64(channel) * int64(level) / 255
+	}
+	return Color{Value: scale(r)<<16 | scale(g)<<8 | scale(b)}
+}
+
+// ToHSV converts the color to hue (0-360 degrees), saturation and value
+// (0.0-1.0), the inverse of MakeColorHSV. Grays and black have hue 0.
+func (color *Color) ToHSV() (h, s, v float64) {
+	r, g, b := color.ToRGB()
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+
+	max := math.Max(rf, math.Max(gf, bf))
+	min := math.Min(rf, math.Min(gf, bf))
+	delta := max - min
+
+	v = max
+	if max > 0 {
+		s = delta / max
+	}
+
+	if delta > 0 {
+		switch max {
+		case rf:
+			h = 60 * math.Mod((gf-bf)/delta, 6)
+		case gf:
+			h = 60 * ((bf-rf)/delta + 2)
+		default:
+			h = 60 * ((rf-gf)/delta + 4)
+		}
+		if h < 0 {
+			h += 360
+		}
+	}
+
+	return h, s, v
+}
+
+// CTtoRGB approximates the RGB color of a white light at the given color
+// temperature in Kelvin.
+func CTtoRGB(kelvin int) Color {
+	t := float64(kelvin) / 100.0
+
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+
+	switch {
+	case t >= 66:
+		b = 255
+	case t <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+
+	clamp := func(v float64) int64 {
+		return int64(math.Max(0, math.Min(255, math.Round(v))))
+	}
+
+	return Color{Value: clamp(r)<<16 | clamp(g)<<8 | clamp(b)}
+}
+
+// asciiTable is the alphabet used to encode colors for update_leds
+const asciiTable = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// MatrixFromASCII decodes an update_leds payload (4 characters per LED)
+// back into a matrix.
+func MatrixFromASCII(ascii string) (ColorMatrix, error) {
+	colorMatrix := ColorMatrix{}
+	if len(ascii)%4 != 0 {
+		return colorMatrix, fmt.Errorf("invalid ASCII length %d: must be a multiple of 4", len(ascii))
+	}
+
+	for i := 0; i < len(ascii); i += 4 {
+		var value int64
+		for j := i; j < i+4; j++ {
+			index := strings.IndexByte(asciiTable, ascii[j])
+			if index < 0 {
+				return colorMatrix, fmt.Errorf("invalid ASCII character %q at position %d", ascii[j], j)
+			}
+			value = value*64 + int64(index)
+		}
+		colorMatrix.Colors = append(colorMatrix.Colors, Color{Value: value})
+	}
+
+	return colorMatrix, nil
+}
+
 func (color *Color) ToASCII() (result string) {
-	ASCII_TABLE := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	ASCII_TABLE := asciiTable
 	total_bytes := color.Value / 64
 	colorValue := color.Value % 64
 
@@ -256,12 +850,51 @@ func (r *Response) FromJson(data []byte) error {
 	return json.Unmarshal(data, &r)
 }
 
-func (yl *Yeelight) Connect() (err error) {
-	if yl.ConnectTimeout == 0 {
-		yl.ConnectTimeout = 3 * time.Second
+// YeelightError is an error reported by the lamp in place of a result, e.g.
+// for a parameter out of range or a method unsupported in the current mode.
+type YeelightError struct {
+	Code    int
+	Message string
+}
+
+func (e *YeelightError) Error() string {
+	return fmt.Sprintf("lamp error %d: %s", e.Code, e.Message)
+}
+
+// lampError returns the error reported by the lamp as a *YeelightError, or
+// nil when the response carries a result.
+func (r *Response) lampError() error {
+	if r.Result != nil || r.Error == nil {
+		return nil
+	}
+
+	e, ok := r.Error.(map[string]interface{})
+	if !ok {
+		return &YeelightError{Message: fmt.Sprint(r.Error)}
 	}
 
-	yl.Conn, err = net.DialTimeout("tcp", yl.Address, yl.ConnectTimeout)
+	lampErr := &YeelightError{}
+	if code, err := asInt(e["code"]); err == nil {
+		lampErr.Code = code
+	}
+	lampErr.Message, _ = e["message"].(string)
+	return lampErr
+}
+
+// isQuotaExceeded reports whether the lamp rejected the command because the
+// client command quota was exhausted.
+func (r *Response) isQuotaExceeded() bool {
+	e, ok := r.Error.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	message, _ := e["message"].(string)
+	return strings.Contains(strings.ToLower(message), "quota exceeded")
+}
+
+func (yl *Yeelight) Connect() (err error) {
+	yl.Conn, err = yl.dial()
 	if err != nil {
 		return err
 	}
@@ -269,129 +902,605 @@ func (yl *Yeelight) Connect() (err error) {
 	return nil
 }
 
-func (yl *Yeelight) SendCommand(c Command) (r Response, err error) {
-	c.GenerateID()
-	if err = yl.Connect(); err != nil {
-		return
+// dial opens a new connection to the lamp without storing it in Conn
+func (yl *Yeelight) dial() (net.Conn, error) {
+	return net.DialTimeout("tcp", yl.Address, yl.connectTimeout())
+}
+
+// connectTimeout returns ConnectTimeout, or its default when unset
+func (yl *Yeelight) connectTimeout() time.Duration {
+	if yl.ConnectTimeout == 0 {
+		return DefaultClientConfig().ConnectTimeout
 	}
+	return yl.ConnectTimeout
+}
 
-	if !yl.Persistent {
-		defer yl.Conn.Close()
+// responseTimeout returns ResponseTimeout, or its default when unset
+func (yl *Yeelight) responseTimeout() time.Duration {
+	if yl.ResponseTimeout == 0 {
+		return DefaultClientConfig().ResponseTimeout
 	}
+	return yl.ResponseTimeout
+}
 
-	cmdJSON, err := c.ToJson()
+// SendCommand sends the command and returns the lamp's response. A lamp
+// that doesn't answer within ResponseTimeout, after retries, yields an error
+// wrapping ErrTimeout, and a command the lamp rejects a *YeelightError.
+func (yl *Yeelight) SendCommand(c Command) (r Response, err error) {
+	r, err = yl.send(c, true)
 	if err != nil {
 		return r, err
 	}
 
-	if _, err := fmt.Fprintf(yl.Conn, "%s\r\n", cmdJSON); err != nil {
+	return r, r.lampError()
+}
+
+// send sends the command and waits for the response, reporting a timeout
+// as ErrTimeout but leaving an error reported by the lamp in the response.
+// music allows sending over the music mode connection, see sendMusic.
+func (yl *Yeelight) send(c Command, music bool) (r Response, err error) {
+	r, timedOut, err := yl.sendWithRetry(c, music)
+	if err != nil {
 		return r, err
 	}
+	if timedOut {
+		return r, fmt.Errorf("%w after %s", ErrTimeout, yl.responseTimeout())
+	}
 
-	s := make(chan string)
-	e := make(chan error)
-
-	go func() {
-		reader := bufio.NewReader(yl.Conn)
-		response, err := reader.ReadString('\n')
-		if err != nil {
-			e <- err
-		} else {
-			s <- response
-		}
-		close(s)
-		close(e)
-	}()
+	return r, nil
+}
 
-	if yl.ResponseTimeout == 0 {
-		yl.ResponseTimeout = 500 * time.Millisecond
+// SendRaw sends any method with the given params and returns the lamp's
+// response, for methods without a typed wrapper such as set_ps or
+// bg_start_cf. Neither the method nor its params are validated, and an
+// error reported by the lamp is left in Response.Error. It always uses a
+// regular connection, the lamp doesn't answer over the music mode one.
+func (yl *Yeelight) SendRaw(method string, params ...interface{}) (Response, error) {
+	if params == nil {
+		params = []interface{}{}
 	}
 
-	select {
-	case response := <-s:
-		r.FromJson([]byte(response))
-		return r, nil
-	case err := <-e:
-		return r, err
-	case <-time.After(yl.ResponseTimeout):
-		return r, nil
-	}
+	return yl.send(Command{
+		Method: method,
+		Params: params,
+	}, false)
 }
 
-func (yl *Yeelight) GetProperties(names []string) (r Response, err error) {
+// Probe sends a get_prop command to check that the lamp answers. A lamp that
+// accepts the connection but never responds has LAN Control disabled, which
+// is reported as ErrLANControlDisabled.
+func (yl *Yeelight) Probe() error {
 	c := Command{
 		Method: "get_prop",
-		Params: names,
+		Params: []interface{}{"power"},
 	}
 
-	return yl.SendCommand(c)
+	_, timedOut, err := yl.sendWithRetry(c, false)
+	if err != nil {
+		return err
+	}
+	if timedOut {
+		return ErrLANControlDisabled
+	}
+
+	return nil
 }
 
-func (yl *Yeelight) GetProperty(name string) (r Response, err error) {
-	c := Command{
-		Method: "get_prop",
-		Params: []interface{}{name},
+// nonIdempotentMethods change the lamp relative to its current state or add
+// to it. A timed out command may still have been executed, so these are
+// never resent.
+var nonIdempotentMethods = map[string]bool{
+	"toggle":        true,
+	"set_adjust":    true,
+	"adjust_bright": true,
+	"adjust_ct":     true,
+	"adjust_color":  true,
+	"cron_add":      true,
+}
+
+// sendWithRetry sends the command, resending it over a fresh connection when
+// the response times out and the method is safe to repeat. timedOut reports
+// whether the last attempt timed out.
+func (yl *Yeelight) sendWithRetry(c Command, music bool) (r Response, timedOut bool, err error) {
+	c.GenerateID()
+
+	retries := yl.TimeoutRetries
+	if retries == 0 {
+		retries = 1
+	}
+	if nonIdempotentMethods[c.Method] {
+		retries = 0
 	}
 
-	return yl.SendCommand(c)
+	// The lamp is sometimes slow to answer the first command after being
+	// idle, so a timed out command is resent over a fresh connection.
+	for attempt := 0; ; attempt++ {
+		r, timedOut, err = yl.sendOnce(c, music)
+		if !timedOut || attempt >= retries {
+			return r, timedOut, err
+		}
+	}
 }
 
-// Wrapper Methods
+// sendOnce dials the lamp, writes the command and waits for its response.
+// timedOut is set when the command was written but no response arrived
+// within ResponseTimeout.
+func (yl *Yeelight) sendOnce(c Command, music bool) (r Response, timedOut bool, err error) {
+	if music {
+		if r, ok := yl.sendMusic(c); ok {
+			return r, false, nil
+		}
+	}
 
-func (yl *Yeelight) SetHexColor(color string, options Options) (err error) {
-	color = strings.Replace(color, "#", "", -1)
-	n, err := strconv.ParseUint(color, 16, 64)
-	if err != nil {
-		return
+	if yl.Pool != nil {
+		return yl.sendPooled(c)
 	}
 
-	c := Command{
-		Method: "set_rgb",
-		Params: []interface{}{n, "smooth", options.Smooth},
+	if yl.Persistent {
+		return yl.sendPersistent(c)
 	}
 
-	_, err = yl.SendCommand(c)
+	// A connection per command, Conn belongs to the persistent mode
+	conn, err := yl.dial()
 	if err != nil {
-		return
+		return r, false, err
 	}
+	defer conn.Close()
 
-	return nil
+	return yl.exchange(conn, bufio.NewReader(conn), c)
 }
 
-func (yl *Yeelight) GetHexColor() (h string, err error) {
-	r, err := yl.GetProperty("rgb")
-	if err != nil {
-		return h, err
+// sendPersistent sends the command over the connection kept open in Conn,
+// dialing when there is none or the lamp closed it. When the write or read
+// fails on a reused connection, e.g. with a broken pipe, the command is
+// resent once over a fresh connection.
+func (yl *Yeelight) sendPersistent(c Command) (r Response, timedOut bool, err error) {
+	yl.connMu.Lock()
+	defer yl.connMu.Unlock()
+
+	reused := yl.Conn != nil && yl.connReader != nil && connAlive(yl.Conn, yl.connReader)
+	if !reused {
+		if err = yl.reconnect(); err != nil {
+			return r, false, err
+		}
 	}
 
-	value, err := strconv.Atoi(r.Result.([]interface{})[0].(string))
+	r, timedOut, err = yl.exchange(yl.Conn, yl.connReader, c)
+	if reused && isConnError(err) {
+		// The lamp dropped the connection since it was last used
+		if err = yl.reconnect(); err != nil {
+			return r, false, err
+		}
+		r, timedOut, err = yl.exchange(yl.Conn, yl.connReader, c)
+	}
 
-	rgb := Color{Value: int64(value)}
-	if err != nil {
-		return h, err
+	// A timed out connection may still receive the late response, and
+	// anything but a quota error leaves it in an unknown state
+	if timedOut || (err != nil && !errors.Is(err, ErrQuotaExceeded)) {
+		yl.closeConn()
 	}
-	h = rgb.ToHex()
-	return h, nil
+	return r, timedOut, err
 }
 
-func (yl *Yeelight) SetBright(value int8, options Options) (err error) {
-	c := Command{
-		Method: "set_bright",
-		Params: []interface{}{value, "smooth", options.Smooth},
+// reconnect replaces the persistent connection with a fresh one
+func (yl *Yeelight) reconnect() error {
+	yl.closeConn()
+	if err := yl.Connect(); err != nil {
+		return err
 	}
+	yl.connReader = bufio.NewReader(yl.Conn)
+	return nil
+}
 
-	_, err = yl.SendCommand(c)
-	if err != nil {
-		return
+// closeConn closes the persistent connection, if any
+func (yl *Yeelight) closeConn() {
+	if yl.Conn != nil {
+		yl.Conn.Close()
+		yl.Conn = nil
 	}
+	yl.connReader = nil
+}
 
-	return nil
+// isConnError reports whether err means the connection is broken, as
+// opposed to e.g. a malformed response
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &opErr)
 }
 
-func (yl *Yeelight) SetColorTemperature(value int16, options Options) (err error) {
+// exchange writes the command to conn and waits for its response on reader,
+// see sendOnce.
+func (yl *Yeelight) exchange(conn net.Conn, reader *bufio.Reader, c Command) (r Response, timedOut bool, err error) {
+	cmdJSON, err := c.ToJson()
+	if err != nil {
+		return r, false, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\r\n", cmdJSON); err != nil {
+		return r, false, err
+	}
+
+	s := make(chan Response, 1)
+	e := make(chan error, 1)
+
+	go func() {
+		response, err := yl.readResponse(reader, c.ID)
+		if err != nil {
+			e <- err
+		} else {
+			s <- response
+		}
+		close(s)
+		close(e)
+	}()
+
+	select {
+	case r = <-s:
+		if r.isQuotaExceeded() {
+			return r, false, ErrQuotaExceeded
+		}
+		return r, false, nil
+	case err := <-e:
+		return r, false, err
+	case <-time.After(yl.responseTimeout()):
+		return r, true, nil
+	}
+}
+
+// readResponse reads lines from the lamp until the response matching id
+// arrives. Blank lines are skipped, and "props" notifications received in the
+// meantime are handed to OnNotification instead of being mistaken for the
+// command response.
+func (yl *Yeelight) readResponse(reader *bufio.Reader, id int32) (r Response, err error) {
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		if line != "" {
+			n := Notification{}
+			if err := json.Unmarshal([]byte(line), &n); err == nil && n.Method == "props" {
+				if yl.OnNotification != nil {
+					yl.OnNotification(n)
+				}
+			} else {
+				r = Response{}
+				if err := r.FromJson([]byte(line)); err != nil {
+					return r, fmt.Errorf("invalid response %q: %w", line, err)
+				}
+				if r.ID == id {
+					return r, nil
+				}
+			}
+		}
+
+		if readErr != nil {
+			return r, readErr
+		}
+	}
+}
+
+func (yl *Yeelight) GetProperties(names []string) (r Response, err error) {
+	c := Command{
+		Method: "get_prop",
+		Params: names,
+	}
+
+	return yl.SendCommand(c)
+}
+
+func (yl *Yeelight) GetProperty(name string) (r Response, err error) {
+	c := Command{
+		Method: "get_prop",
+		Params: []interface{}{name},
+	}
+
+	return yl.SendCommand(c)
+}
+
+// StateProperties are the properties read by GetState.
+var StateProperties = []string{"power", "bright", "ct", "rgb", "hue", "sat", "color_mode", "flowing", "delayoff", "name"}
+
+// GetPropertiesMap reads the given properties and returns their values by
+// name. Unsupported properties have an empty value.
+func (yl *Yeelight) GetPropertiesMap(names []string) (map[string]string, error) {
+	c := Command{
+		Method: "get_prop",
+		Params: names,
+	}
+
+	r, err := yl.SendCommand(c)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := resultList(r, "get_prop")
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != len(names) {
+		return nil, fmt.Errorf("%w: get_prop returned %v", ErrInvalidResponse, r.Result)
+	}
+
+	properties := make(map[string]string, len(names))
+	for i, name := range names {
+		properties[name] = asString(result[i])
+	}
+
+	return properties, nil
+}
+
+// GetState reads the common StateProperties of the lamp.
+func (yl *Yeelight) GetState() (map[string]string, error) {
+	return yl.GetPropertiesMap(StateProperties)
+}
+
+// Wrapper Methods
+
+func (yl *Yeelight) SetHexColor(color string, options Options) (err error) {
+	color = strings.Replace(color, "#", "", -1)
+	n, err := strconv.ParseUint(color, 16, 64)
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		return ErrBlackColor
+	}
+
+	effect, duration := options.effect()
+	c := Command{
+		Method: "set_rgb",
+		Params: []interface{}{n, effect, duration},
+	}
+
+	_, err = yl.SendCommand(c)
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+// BgSetHexColor sets the color of the background (ambient) light on
+// dual-light models.
+func (yl *Yeelight) BgSetHexColor(color string, options Options) error {
+	n, err := strconv.ParseUint(strings.Replace(color, "#", "", -1), 16, 64)
+	if err != nil || n > 0xFFFFFF {
+		return fmt.Errorf("invalid color: %s", color)
+	}
+	if n == 0 {
+		return ErrBlackColor
+	}
+
+	effect, duration := options.effect()
+	c := Command{
+		Method: "bg_set_rgb",
+		Params: []interface{}{n, effect, duration},
+	}
+
+	_, err = yl.SendCommand(c)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetColorBright sets color and brightness in a single set_scene command,
+// turning the lamp on if needed. This avoids the flicker of separate
+// set_power, set_rgb and set_bright calls. set_scene has no transition
+// parameter, the change is always immediate.
+func (yl *Yeelight) SetColorBright(hex string, bright int) error {
+	return yl.SetSceneColor(hex, bright)
+}
+
+// SetSceneColor sets color and brightness in a single set_scene command,
+// turning the lamp on if needed.
+func (yl *Yeelight) SetSceneColor(hex string, bright int) error {
+	n, err := strconv.ParseUint(strings.Replace(hex, "#", "", -1), 16, 64)
+	if err != nil || n > 0xFFFFFF {
+		return fmt.Errorf("invalid color: %s", hex)
+	}
+	if n == 0 {
+		return ErrBlackColor
+	}
+
+	return yl.setScene("color", n, bright)
+}
+
+// SetSceneCT sets color temperature in Kelvin and brightness in a single
+// set_scene command, turning the lamp on if needed.
+func (yl *Yeelight) SetSceneCT(temp int16, bright int) error {
+	min, max := yl.ctRange()
+	if int(temp) < min || int(temp) > max {
+		return fmt.Errorf("invalid color temperature: %d (must be %d-%d)", temp, min, max)
+	}
+
+	return yl.setScene("ct", temp, bright)
+}
+
+// SetSceneAutoDelayOff turns the lamp on at the given brightness and turns
+// it off again after minutes, in a single set_scene command.
+func (yl *Yeelight) SetSceneAutoDelayOff(bright int, minutes int) error {
+	if minutes < 1 {
+		return fmt.Errorf("invalid delay: %d minutes (must be at least 1)", minutes)
+	}
+
+	if bright < 1 || bright > 100 {
+		return fmt.Errorf("invalid brightness: %d (must be 1-100)", bright)
+	}
+
+	c := Command{
+		Method: "set_scene",
+		Params: []interface{}{"auto_delay_off", bright, minutes},
+	}
+
+	_, err := yl.SendCommand(c)
+	return err
+}
+
+// setScene sends set_scene with a class, its value and a brightness
+func (yl *Yeelight) setScene(class string, value interface{}, bright int) error {
+	if bright < 1 || bright > 100 {
+		return fmt.Errorf("invalid brightness: %d (must be 1-100)", bright)
+	}
+
+	c := Command{
+		Method: "set_scene",
+		Params: []interface{}{class, value, bright},
+	}
+
+	_, err := yl.SendCommand(c)
+	return err
+}
+
+// SetRGBInt sets the color from a 24-bit 0xRRGGBB value, e.g. one read
+// with GetRGB or a Color's Value, without formatting it as hex.
+func (yl *Yeelight) SetRGBInt(value int64, options Options) error {
+	if value < 0 || value > 0xFFFFFF {
+		return fmt.Errorf("invalid color: %d (must be 0-0xFFFFFF)", value)
+	}
+	if value == 0 {
+		return ErrBlackColor
+	}
+
+	effect, duration := options.effect()
+	c := Command{
+		Method: "set_rgb",
+		Params: []interface{}{value, effect, duration},
+	}
+
+	_, err := yl.SendCommand(c)
+	return err
+}
+
+func (yl *Yeelight) GetHexColor() (h string, err error) {
+	rgb, err := yl.getColor()
+	if err != nil {
+		return h, err
+	}
+
+	h = rgb.ToHex()
+	return h, nil
+}
+
+// GetRGB reads the current color of the lamp as its red, green and blue
+// channels.
+func (yl *Yeelight) GetRGB() (r, g, b uint8, err error) {
+	rgb, err := yl.getColor()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	r, g, b = rgb.ToRGB()
+	return r, g, b, nil
+}
+
+// getColor reads the rgb property, a decimal 0xRRGGBB value
+func (yl *Yeelight) getColor() (Color, error) {
+	r, err := yl.GetProperty("rgb")
+	if err != nil {
+		return Color{}, err
+	}
+
+	value, err := firstResultInt64(r, "rgb")
+	if err != nil {
+		return Color{}, err
+	}
+	if value < 0 || value > 0xFFFFFF {
+		return Color{}, fmt.Errorf("%w: rgb out of range: %d", ErrInvalidResponse, value)
+	}
+
+	return Color{Value: value}, nil
+}
+
+func (yl *Yeelight) SetBright(value int8, options Options) (err error) {
+	effect, duration := options.effect()
+	c := Command{
+		Method: "set_bright",
+		Params: []interface{}{value, effect, duration},
+	}
+
+	_, err = yl.SendCommand(c)
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+// minRampStep is the shortest interval between RampBright steps, keeping the
+// ramp well within the lamp's quota of about 60 commands per minute.
+const minRampStep = time.Second
+
+// RampBright changes brightness from one level to another over the given
+// duration in small steps, sent from a goroutine. Each step uses a smooth
+// transition that lasts until the next one. The returned function stops the
+// ramp; the ramp also stops on the first failed command.
+func (yl *Yeelight) RampBright(from, to int, duration time.Duration) (stop func(), err error) {
+	return yl.RampBrightWithEasing(from, to, duration, Linear)
+}
+
+// RampBrightWithEasing is like RampBright, but spaces the brightness levels
+// of the steps along the given easing curve.
+func (yl *Yeelight) RampBrightWithEasing(from, to int, duration time.Duration, easing Easing) (stop func(), err error) {
+	if from < 1 || from > 100 || to < 1 || to > 100 {
+		return nil, fmt.Errorf("invalid brightness range %d-%d (must be 1-100)", from, to)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("ramp duration must be positive")
+	}
+
+	steps := abs(to - from)
+	if maxSteps := int(duration / minRampStep); steps > maxSteps {
+		steps = maxSteps
+	}
+	if steps < 1 {
+		steps = 1
+	}
+	stepDuration := duration / time.Duration(steps)
+
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+	}
+
+	go func() {
+		ticker := time.NewTicker(stepDuration)
+		defer ticker.Stop()
+
+		for step := 0; step <= steps; step++ {
+			progress := easing.Apply(float64(step) / float64(steps))
+			value := from + int(math.Round(float64(to-from)*progress))
+			smooth := Options{Smooth: int(stepDuration / time.Millisecond)}
+			if err := yl.SetBright(int8(value), smooth); err != nil {
+				return
+			}
+			if step == steps {
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return stop, nil
+}
+
+func (yl *Yeelight) SetColorTemperature(value int16, options Options) (err error) {
+	min, max := yl.ctRange()
+	if int(value) < min || int(value) > max {
+		return fmt.Errorf("invalid color temperature: %d (must be %d-%d)", value, min, max)
+	}
+
+	effect, duration := options.effect()
 	c := Command{
 		Method: "set_ct_abx",
-		Params: []interface{}{value, "smooth", options.Smooth},
+		Params: []interface{}{value, effect, duration},
 	}
 
 	_, err = yl.SendCommand(c)
@@ -402,25 +1511,135 @@ func (yl *Yeelight) SetColorTemperature(value int16, options Options) (err error
 	return nil
 }
 
+// Actions of the AdjustBright, AdjustCT and AdjustColor methods.
+const (
+	AdjustIncrease = "increase"
+	AdjustDecrease = "decrease"
+	// AdjustCircle increases the value, wrapping around to the minimum
+	// after the maximum
+	AdjustCircle = "circle"
+)
+
+// AdjustBright changes the brightness relative to the current one with
+// set_adjust, e.g. for a knob. action is AdjustIncrease, AdjustDecrease or
+// AdjustCircle.
+func (yl *Yeelight) AdjustBright(action string) error {
+	return yl.adjust(action, "bright")
+}
+
+// AdjustCT changes the color temperature relative to the current one, see
+// AdjustBright.
+func (yl *Yeelight) AdjustCT(action string) error {
+	return yl.adjust(action, "ct")
+}
+
+// AdjustColor changes the color relative to the current one, see
+// AdjustBright. The lamp only cycles colors, so AdjustCircle is the only
+// action accepted.
+func (yl *Yeelight) AdjustColor(action string) error {
+	if action == AdjustIncrease || action == AdjustDecrease {
+		return fmt.Errorf("invalid color adjust action: %q (only %q is supported)", action, AdjustCircle)
+	}
+	return yl.adjust(action, "color")
+}
+
+// adjust sends set_adjust for the property after validating the action
+func (yl *Yeelight) adjust(action, prop string) error {
+	switch action {
+	case AdjustIncrease, AdjustDecrease, AdjustCircle:
+	default:
+		return fmt.Errorf("invalid adjust action: %q (must be %s, %s or %s)", action, AdjustIncrease, AdjustDecrease, AdjustCircle)
+	}
+
+	c := Command{
+		Method: "set_adjust",
+		Params: []interface{}{action, prop},
+	}
+
+	_, err := yl.SendCommand(c)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// minAdjustDuration is the shortest transition accepted by adjust_bright
+const minAdjustDuration = 30 * time.Millisecond
+
+// AdjustBrightPercent changes the brightness by delta percent of the full
+// range (-100 to 100) with adjust_bright, in a transition lasting duration
+// (at least 30ms). 0 uses DefaultOptions.Smooth. The lamp keeps the result
+// within 1-100.
+func (yl *Yeelight) AdjustBrightPercent(delta int, duration time.Duration) error {
+	if delta < -100 || delta > 100 {
+		return fmt.Errorf("invalid brightness adjustment: %d (must be -100-100)", delta)
+	}
+
+	if duration == 0 {
+		duration = time.Duration(DefaultOptions.Smooth) * time.Millisecond
+	}
+	if duration < minAdjustDuration {
+		return fmt.Errorf("invalid adjustment duration: %v (must be at least %v)", duration, minAdjustDuration)
+	}
+
+	c := Command{
+		Method: "adjust_bright",
+		Params: []interface{}{delta, int(duration / time.Millisecond)},
+	}
+
+	_, err := yl.SendCommand(c)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ctRange returns the color temperature range accepted by the lamp.
+func (yl *Yeelight) ctRange() (int, int) {
+	min, max := yl.CTMin, yl.CTMax
+	if min == 0 {
+		min = DefaultCTMin
+	}
+	if max == 0 {
+		max = DefaultCTMax
+	}
+	return min, max
+}
+
 func (yl *Yeelight) GetBright() (value int8, err error) {
 	r, err := yl.GetProperty("bright")
 	if err != nil {
 		return value, err
 	}
-	v, err := strconv.ParseInt(r.Result.([]interface{})[0].(string), 10, 8)
+	v, err := firstResultInt(r, "bright")
 	if err != nil {
 		return value, err
 	}
+	if v < 0 || v > 100 {
+		return value, fmt.Errorf("unexpected bright value: %d", v)
+	}
 
 	value = int8(v)
 
 	return value, nil
 }
 
+// GetColorTemperature returns the color temperature in Kelvin.
+func (yl *Yeelight) GetColorTemperature() (int, error) {
+	r, err := yl.GetProperty("ct")
+	if err != nil {
+		return 0, err
+	}
+	return firstResultInt(r, "ct")
+}
+
 func (yl *Yeelight) SetOn(options Options) (err error) {
+	effect, duration := options.effect()
 	c := Command{
 		Method: "set_power",
-		Params: []interface{}{"on", "smooth", options.Smooth},
+		Params: []interface{}{"on", effect, duration},
 	}
 
 	_, err = yl.SendCommand(c)
@@ -432,9 +1651,10 @@ func (yl *Yeelight) SetOn(options Options) (err error) {
 }
 
 func (yl *Yeelight) SetOff(options Options) (err error) {
+	effect, duration := options.effect()
 	c := Command{
 		Method: "set_power",
-		Params: []interface{}{"off", "smooth", options.Smooth},
+		Params: []interface{}{"off", effect, duration},
 	}
 
 	_, err = yl.SendCommand(c)
@@ -445,6 +1665,24 @@ func (yl *Yeelight) SetOff(options Options) (err error) {
 	return nil
 }
 
+// EnsureOn turns the lamp on only if it isn't on already, saving a command
+// and the flicker of a repeated transition. If the power state can't be
+// read the command is sent anyway.
+func (yl *Yeelight) EnsureOn(options Options) error {
+	if power, err := yl.getStringProperty("power"); err == nil && power == "on" {
+		return nil
+	}
+	return yl.SetOn(options)
+}
+
+// EnsureOff turns the lamp off only if it isn't off already, see EnsureOn.
+func (yl *Yeelight) EnsureOff(options Options) error {
+	if power, err := yl.getStringProperty("power"); err == nil && power == "off" {
+		return nil
+	}
+	return yl.SetOff(options)
+}
+
 func (yl *Yeelight) Toggle() (err error) {
 	c := Command{
 		Method: "toggle",
@@ -465,11 +1703,19 @@ func (yl *Yeelight) IsOn() (b bool, err error) {
 		return b, err
 	}
 
-	b = (r.Result.([]interface{})[0].(string) == "on")
+	power, err := firstResultString(r, "power")
+	if err != nil {
+		return b, err
+	}
+	b = power == "on"
 
-	return b, err
+	return b, nil
 }
 
+// Sleep schedules the lamp to turn off after s minutes.
+//
+// Deprecated: Sleep is limited to 127 minutes by its int8 argument and sends
+// s unchecked. Use SetDelayOff instead.
 func (yl *Yeelight) Sleep(s int8) (err error) {
 	c := Command{
 		Method: "cron_add",
@@ -484,23 +1730,193 @@ func (yl *Yeelight) Sleep(s int8) (err error) {
 	return nil
 }
 
+// maxDelayOff is the longest delay-off timer accepted, in minutes.
+const maxDelayOff = 24 * 60
+
+// SetDelayOff schedules the lamp to turn off after the given number of
+// minutes (1 to 1440).
+func (yl *Yeelight) SetDelayOff(minutes int) error {
+	if minutes < 1 || minutes > maxDelayOff {
+		return fmt.Errorf("invalid delay-off: %d minutes (must be 1-%d)", minutes, maxDelayOff)
+	}
+
+	c := Command{
+		Method: "cron_add",
+		Params: []interface{}{0, minutes},
+	}
+
+	_, err := yl.SendCommand(c)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetDelayOff returns the minutes left before the lamp turns off, or 0 when
+// no delay-off timer is set.
+func (yl *Yeelight) GetDelayOff() (int, error) {
+	c := Command{
+		Method: "cron_get",
+		Params: []interface{}{0},
+	}
+
+	r, err := yl.SendCommand(c)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := resultList(r, "cron_get")
+	if err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+
+	job, ok := result[0].(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected cron job: %v", result[0])
+	}
+
+	delay, err := asInt(job["delay"])
+	if err != nil {
+		return 0, fmt.Errorf("unexpected cron delay: %w", err)
+	}
+
+	return delay, nil
+}
+
+// CancelDelayOff removes the delay-off timer.
+func (yl *Yeelight) CancelDelayOff() error {
+	c := Command{
+		Method: "cron_del",
+		Params: []interface{}{0},
+	}
+
+	_, err := yl.SendCommand(c)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetMatrix sends the matrices in a single update_leds, one per chained
+// matrix module.
 func (yl *Yeelight) SetMatrix(matrix []ColorMatrix) (err error) {
+	if len(matrix) == 0 {
+		return errors.New("no matrix to send")
+	}
+
 	ascii := ""
 
 	for _, element := range matrix {
+		// Per-LED brightness is folded into the colors first, the lamp
+		// only takes colors
+		element = element.Flatten()
+		if yl.Gamma > 0 && yl.Gamma != 1 {
+			element.GammaCorrect(yl.Gamma)
+		}
+		if yl.MaxTotalBrightness > 0 {
+			element = limitBrightness(element, yl.MaxTotalBrightness)
+		}
 		ascii += element.ToASCII()
 	}
 
-	err = yl.SetASCII(ascii)
+	// Chained modules take one matrix each in a single update_leds
+	err = yl.setASCII(ascii, len(matrix)*yl.ledCount())
 
 	if err != nil {
 		return
 	}
 
+	if len(matrix) == 1 {
+		yl.stateMu.Lock()
+		yl.lastMatrix = matrix[0].Flatten()
+		yl.stateMu.Unlock()
+	}
+
 	return nil
 }
 
+// geometry returns the LED layout of the lamp, see Geometry
+func (yl *Yeelight) geometry() Geometry {
+	return yl.Geometry.orDefault()
+}
+
+// ledCount returns the number of LEDs of one matrix module, see LEDCount
+func (yl *Yeelight) ledCount() int {
+	if yl.LEDCount > 0 {
+		return yl.LEDCount
+	}
+	return yl.geometry().LEDs()
+}
+
+// SetPixels changes only the given LEDs of the frame last sent by
+// SetMatrix (a black frame if none was sent). update_leds can't address
+// single LEDs, so the full frame is sent, but nothing is sent when the
+// changes don't alter it.
+func (yl *Yeelight) SetPixels(changes map[Vector]Color) error {
+	yl.stateMu.Lock()
+	base := yl.lastMatrix
+	yl.stateMu.Unlock()
+
+	g := yl.geometry()
+	sent := len(base.Colors) > 0
+	if !sent {
+		base = g.MakeMatrix("#000000")
+	}
+
+	frame := ColorMatrix{Colors: append([]Color(nil), base.Colors...), Width: g.Cols}
+	for v, c := range changes {
+		if !frame.contains(v) {
+			return fmt.Errorf("pixel out of range: row %d, column %d (allowed rows 0-%d, columns 0-%d)", v.Row, v.Column, g.Rows-1, g.Cols-1)
+		}
+		frame.SetColor(v, c)
+	}
+
+	if sent && len(base.Diff(frame)) == 0 {
+		return nil
+	}
+
+	return yl.SetMatrix([]ColorMatrix{frame})
+}
+
+// TotalBrightness returns the summed perceived brightness of all LEDs, where
+// each LED contributes between 0.0 (black) and 1.0 (white).
+func (matrix *ColorMatrix) TotalBrightness() float64 {
+	total := 0.0
+	for index, element := range matrix.Colors {
+		element = element.scaled(matrix.brightness(index))
+		r, g, b := element.ToRGB()
+		total += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 255
+	}
+	return total
+}
+
+// limitBrightness returns a copy of the matrix scaled down so its total
+// brightness does not exceed max.
+func limitBrightness(matrix ColorMatrix, max float64) ColorMatrix {
+	total := matrix.TotalBrightness()
+	if total <= max {
+		return matrix
+	}
+
+	limited := matrix.Flatten()
+	dimMatrix(&limited, max/total)
+	return limited
+}
+
 func (yl *Yeelight) SetASCII(ascii string) (err error) {
+	return yl.setASCII(ascii, yl.ledCount())
+}
+
+// setASCII sends ascii to update_leds after checking it covers leds LEDs
+func (yl *Yeelight) setASCII(ascii string, leds int) (err error) {
+	if expected := leds * asciiCharsPerLED; len(ascii) != expected {
+		return fmt.Errorf("matrix size mismatch: got %d chars, expected %d", len(ascii), expected)
+	}
 
 	c := Command{
 		Method: "update_leds",
@@ -535,16 +1951,33 @@ func (yl *Yeelight) SetDirectMode() (err error) {
 // action: what to do after the flow finishes.
 // flow: a slice of FlowState structs defining the flow.
 func (yl *Yeelight) StartCf(count int, action CfAction, flow []FlowState) error {
-	var stateStrings []string
-	for _, state := range flow {
-		s := fmt.Sprintf("%d,%d,%d,%d", state.Duration, state.Mode, state.Value, state.Brightness)
-		stateStrings = append(stateStrings, s)
+	if err := validateFlow(flow, count, action); err != nil {
+		return err
 	}
-	flowExpression := strings.Join(stateStrings, ",")
 
 	c := Command{
 		Method: "start_cf",
-		Params: []interface{}{count, int(action), flowExpression},
+		Params: []interface{}{count, int(action), flowExpression(flow)},
+	}
+
+	_, err := yl.SendCommand(c)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// StartSceneFlow turns the lamp on and starts a color flow in a single
+// set_scene command, avoiding the flash of a separate power on.
+func (yl *Yeelight) StartSceneFlow(flow []FlowState, count int, action CfAction) error {
+	if err := validateFlow(flow, count, action); err != nil {
+		return err
+	}
+
+	c := Command{
+		Method: "set_scene",
+		Params: []interface{}{"cf", count, int(action), flowExpression(flow)},
 	}
 
 	_, err := yl.SendCommand(c)
@@ -555,6 +1988,51 @@ func (yl *Yeelight) StartCf(count int, action CfAction, flow []FlowState) error
 	return nil
 }
 
+// minFlowDuration is the shortest flow state duration accepted by the lamp,
+// in milliseconds.
+const minFlowDuration = 50
+
+// validateFlow checks the parameters of a color flow, which the lamp would
+// otherwise reject without saying why.
+func validateFlow(flow []FlowState, count int, action CfAction) error {
+	if len(flow) == 0 {
+		return fmt.Errorf("flow must contain at least one state")
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid flow count: %d (must be 0 or more)", count)
+	}
+	if action < CfActionRecover || action > CfActionOff {
+		return fmt.Errorf("invalid flow action: %d", action)
+	}
+
+	for i, state := range flow {
+		if state.Duration < minFlowDuration {
+			return fmt.Errorf("flow state %d: invalid duration: %dms (must be at least %dms)", i, state.Duration, minFlowDuration)
+		}
+		switch state.Mode {
+		case FlowModeColor, FlowModeTemp, FlowModeSleep:
+		default:
+			return fmt.Errorf("flow state %d: invalid mode: %d", i, state.Mode)
+		}
+		if state.Mode != FlowModeSleep && state.Brightness != -1 && (state.Brightness < 1 || state.Brightness > 100) {
+			return fmt.Errorf("flow state %d: invalid brightness: %d (must be -1 or 1-100)", i, state.Brightness)
+		}
+	}
+
+	return nil
+}
+
+// flowExpression encodes flow states as the comma separated expression
+// used by start_cf and set_scene.
+func flowExpression(flow []FlowState) string {
+	var stateStrings []string
+	for _, state := range flow {
+		s := fmt.Sprintf("%d,%d,%d,%d", state.Duration, state.Mode, state.Value, state.Brightness)
+		stateStrings = append(stateStrings, s)
+	}
+	return strings.Join(stateStrings, ",")
+}
+
 // StopCf stops the currently running color flow.
 func (yl *Yeelight) StopCf() error {
 	c := Command{
@@ -570,8 +2048,77 @@ func (yl *Yeelight) StopCf() error {
 	return nil
 }
 
+// IsFlowing reports whether a color flow is currently running.
+func (yl *Yeelight) IsFlowing() (bool, error) {
+	value, err := yl.getStringProperty("flowing")
+	if err != nil {
+		return false, err
+	}
+
+	switch value {
+	case "1":
+		return true, nil
+	case "0", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected flowing value: %q", value)
+	}
+}
+
+// GetFlowParams returns the raw flow_params property describing the color
+// flow last started on the lamp, see ParseFlowExpression. It returns
+// ErrUnsupported when the lamp doesn't report the property.
+func (yl *Yeelight) GetFlowParams() (string, error) {
+	value, err := yl.getStringProperty("flow_params")
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", fmt.Errorf("%w: flow_params is not reported", ErrUnsupported)
+	}
+	return value, nil
+}
+
+// ParseFlowExpression decodes a flow expression as used by start_cf, four
+// comma separated values per state, back into flow states. The flow_params
+// property of some models is prefixed with the flow's count and action,
+// such an expression of 4n+2 values has the prefix skipped.
+func ParseFlowExpression(expr string) ([]FlowState, error) {
+	var values []int
+	for _, field := range strings.Split(expr, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid flow expression: %q is not a number", field)
+		}
+		values = append(values, value)
+	}
+
+	if len(values)%4 == 2 {
+		values = values[2:]
+	}
+	if len(values) == 0 || len(values)%4 != 0 {
+		return nil, fmt.Errorf("invalid flow expression: %d values, expected 4 per state", len(values))
+	}
+
+	flow := make([]FlowState, 0, len(values)/4)
+	for i := 0; i < len(values); i += 4 {
+		flow = append(flow, FlowState{
+			Duration:   values[i],
+			Mode:       FlowMode(values[i+1]),
+			Value:      values[i+2],
+			Brightness: values[i+3],
+		})
+	}
+	return flow, nil
+}
+
+// Disconnect closes the connection kept open by Persistent. The next
+// command dials a new one.
 func (yl *Yeelight) Disconnect() {
-	yl.Conn.Close()
+	yl.connMu.Lock()
+	defer yl.connMu.Unlock()
+
+	yl.closeConn()
 }
 
 // SetName sets a new name for the Yeelight.
@@ -587,4 +2134,292 @@ func (yl *Yeelight) SetName(name string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// GetName returns the name stored on the Yeelight.
+func (yl *Yeelight) GetName() (string, error) {
+	return yl.getStringProperty("name")
+}
+
+// getStringProperty reads a single property and returns its string value.
+func (yl *Yeelight) getStringProperty(name string) (string, error) {
+	r, err := yl.GetProperty(name)
+	if err != nil {
+		return "", err
+	}
+	return firstResultString(r, name)
+}
+
+// firstResultString returns the first result value of a response as a
+// string, whether the lamp sent it as a string or a number.
+func firstResultString(r Response, name string) (string, error) {
+	result, err := resultList(r, name)
+	if err != nil {
+		return "", err
+	}
+	if len(result) == 0 {
+		return "", fmt.Errorf("%w: empty result for %s", ErrInvalidResponse, name)
+	}
+
+	switch result[0].(type) {
+	case string, float64, json.Number:
+		return asString(result[0]), nil
+	}
+	return "", fmt.Errorf("unexpected %s value: %v", name, result[0])
+}
+
+// resultList returns the result values of a response, or an error when the
+// lamp answered with something other than a list.
+func resultList(r Response, name string) ([]interface{}, error) {
+	result, ok := r.Result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected response for %s: %v", ErrInvalidResponse, name, r.Result)
+	}
+	return result, nil
+}
+
+// firstResultInt returns the first result value of a response as an int,
+// see asInt.
+func firstResultInt(r Response, name string) (int, error) {
+	value, err := firstResultInt64(r, name)
+	return int(value), err
+}
+
+// firstResultInt64 returns the first result value of a response as an
+// int64, see asInt64.
+func firstResultInt64(r Response, name string) (int64, error) {
+	result, err := resultList(r, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, fmt.Errorf("%w: empty result for %s", ErrInvalidResponse, name)
+	}
+
+	value, err := asInt64(result[0])
+	if err != nil {
+		return 0, fmt.Errorf("unexpected %s value: %w", name, err)
+	}
+	return value, nil
+}
+
+// asInt converts a result value to an int, see asInt64.
+func asInt(v interface{}) (int, error) {
+	n, err := asInt64(v)
+	return int(n), err
+}
+
+// asInt64 converts a result value to an int64. Most firmwares send property
+// values as strings, but some send numbers. Values such as rgb (up to
+// 16777215) are parsed as 64 bits regardless of the platform's int size.
+func asInt64(v interface{}) (int64, error) {
+	switch value := v.(type) {
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case float64:
+		if value != math.Trunc(value) {
+			return 0, fmt.Errorf("not an integer: %v", value)
+		}
+		return int64(value), nil
+	case json.Number:
+		return value.Int64()
+	case int:
+		return int64(value), nil
+	}
+	return 0, fmt.Errorf("not a number: %v", v)
+}
+
+// asString formats a result value without the exponent notation fmt uses
+// for large float64 numbers.
+func asString(v interface{}) string {
+	if value, ok := v.(float64); ok {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Supports reports whether the lamp supports the given method. When the
+// supported methods are unknown it optimistically returns true.
+func (yl *Yeelight) Supports(method string) bool {
+	if len(yl.Support) == 0 {
+		return true
+	}
+
+	for _, m := range yl.Support {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetMatrixSupported reports whether the lamp can read back the colors
+// currently shown on its LEDs. None of the known models, including the
+// Cube, expose per-LED readback over the LAN protocol.
+func (yl *Yeelight) GetMatrixSupported() bool {
+	return false
+}
+
+// GetMatrix reads back the colors currently shown on the lamp's LEDs. As no
+// known model supports this, it always returns ErrUnsupported.
+func (yl *Yeelight) GetMatrix() (ColorMatrix, error) {
+	return ColorMatrix{}, ErrUnsupported
+}
+
+// Power modes of set_power, selecting the light used when turning on.
+const (
+	powerModeNormal     = 1
+	powerModeNightlight = 5
+)
+
+// supportsNightlight reports whether the lamp has a nightlight (moonlight)
+// mode. Only such models report the active_mode property.
+func (yl *Yeelight) supportsNightlight() (bool, error) {
+	if !yl.Supports("set_power") {
+		return false, nil
+	}
+
+	properties, err := yl.GetPropertiesMap([]string{"active_mode"})
+	if err != nil {
+		return false, err
+	}
+
+	return properties["active_mode"] != "", nil
+}
+
+// SetNightlight switches the lamp to its warm low-power nightlight mode
+// with the given brightness (1-100), turning it on if needed. It returns
+// ErrUnsupported on models without a nightlight.
+func (yl *Yeelight) SetNightlight(bright int) error {
+	if bright < 1 || bright > 100 {
+		return fmt.Errorf("invalid brightness: %d (must be 1-100)", bright)
+	}
+
+	supported, err := yl.supportsNightlight()
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return ErrUnsupported
+	}
+
+	effect, duration := DefaultOptions.effect()
+	if _, err := yl.SendCommand(Command{
+		Method: "set_power",
+		Params: []interface{}{"on", effect, duration, powerModeNightlight},
+	}); err != nil {
+		return err
+	}
+
+	_, err = yl.SendCommand(Command{
+		Method: "set_bright",
+		Params: []interface{}{bright, effect, duration},
+	})
+	return err
+}
+
+// SetNormalMode switches the lamp from nightlight back to its normal light,
+// turning it on if needed. It returns ErrUnsupported on models without a
+// nightlight.
+func (yl *Yeelight) SetNormalMode() error {
+	supported, err := yl.supportsNightlight()
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return ErrUnsupported
+	}
+
+	effect, duration := DefaultOptions.effect()
+	_, err = yl.SendCommand(Command{
+		Method: "set_power",
+		Params: []interface{}{"on", effect, duration, powerModeNormal},
+	})
+	return err
+}
+
+// Power-on behaviors accepted by SetPowerOnBehavior.
+const (
+	// PowerOnLast restores the state the lamp had when it lost power
+	PowerOnLast = "last"
+	// PowerOnCT powers on to white at the current color temperature and
+	// brightness
+	PowerOnCT = "ct"
+	// PowerOnRGB powers on to the current color and brightness
+	PowerOnRGB = "rgb"
+	// PowerOnOff would keep the lamp off, which the protocol can't
+	// configure; SetPowerOnBehavior rejects it with ErrUnsupported
+	PowerOnOff = "off"
+)
+
+// SetPowerOnBehavior configures what the lamp shows when it is switched on
+// at the wall: PowerOnLast, PowerOnCT or PowerOnRGB. The last two save the
+// lamp's current color temperature or color as its default state with
+// set_default, turning it on if needed. It returns ErrUnsupported when the
+// lamp lacks the commands for the mode, and for PowerOnOff: the protocol has
+// no way to make a lamp stay off when power returns.
+func (yl *Yeelight) SetPowerOnBehavior(mode string) error {
+	switch mode {
+	case PowerOnOff:
+		return fmt.Errorf("%w: the lamp always turns on when power returns, staying off can't be configured", ErrUnsupported)
+
+	case PowerOnLast:
+		if !yl.Supports("set_ps") {
+			return ErrUnsupported
+		}
+		_, err := yl.SendCommand(Command{Method: "set_ps", Params: []interface{}{"cfg_save_state", "1"}})
+		return err
+
+	case PowerOnCT, PowerOnRGB:
+		if !yl.Supports("set_scene") || !yl.Supports("set_default") || (mode == PowerOnRGB && !yl.Supports("set_rgb")) {
+			return ErrUnsupported
+		}
+
+		properties, err := yl.GetPropertiesMap([]string{"bright", "ct", "rgb"})
+		if err != nil {
+			return err
+		}
+		bright, err := strconv.Atoi(properties["bright"])
+		if err != nil || bright < 1 || bright > 100 {
+			bright = 100
+		}
+
+		// Without this the saved state would win over the default
+		if yl.Supports("set_ps") {
+			if _, err := yl.SendCommand(Command{Method: "set_ps", Params: []interface{}{"cfg_save_state", "0"}}); err != nil {
+				return err
+			}
+		}
+
+		params := []interface{}{"ct", 0, bright}
+		if mode == PowerOnCT {
+			ct, err := strconv.Atoi(properties["ct"])
+			if err != nil || ct <= 0 {
+				ct = DefaultCTMax
+			}
+			params[1] = ct
+		} else {
+			rgb, err := strconv.Atoi(properties["rgb"])
+			if err != nil || rgb <= 0 {
+				rgb = 0xFFFFFF
+			}
+			params[0], params[1] = "color", rgb
+		}
+		if _, err := yl.SendCommand(Command{Method: "set_scene", Params: params}); err != nil {
+			return err
+		}
+
+		_, err = yl.SendCommand(Command{Method: "set_default", Params: []interface{}{}})
+		return err
+	}
+
+	return fmt.Errorf("unknown power-on behavior: %s (must be %s, %s or %s)", mode, PowerOnLast, PowerOnCT, PowerOnRGB)
+}
@@ -0,0 +1,486 @@
+package yeelight
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetColorBrightPayload(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	if err := yl.SetColorBright("#FF8000", 60); err != nil {
+		t.Fatalf("SetColorBright failed: %v", err)
+	}
+	if got := lamp.methods(); len(got) != 1 || got[0] != "set_scene" {
+		t.Fatalf("sent %v, want a single set_scene", got)
+	}
+	if got, want := lamp.lastParams(t), `["color",16744448,60]`; got != want {
+		t.Errorf("sent params %s, want %s", got, want)
+	}
+
+	if err := yl.SetColorBright("#000000", 60); !errors.Is(err, ErrBlackColor) {
+		t.Errorf("black: got %v, want ErrBlackColor", err)
+	}
+	for _, bright := range []int{0, 101} {
+		if err := yl.SetColorBright("#FF8000", bright); err == nil {
+			t.Errorf("brightness %d was accepted", bright)
+		}
+	}
+	if err := yl.SetColorBright("orange", 60); err == nil {
+		t.Error("invalid color was accepted")
+	}
+	if got := len(lamp.received()); got != 1 {
+		t.Errorf("invalid calls sent %d more commands", got-1)
+	}
+}
+
+func TestHistogramAndDominantColor(t *testing.T) {
+	matrix := MakeMatrix("#0000ff", 25)
+	for column := 0; column < 5; column++ {
+		matrix.SetHex(Vector{Row: 0, Column: column}, "#ff0000")
+	}
+	matrix.SetHex(Vector{Row: 1, Column: 0}, "#00ff00")
+
+	histogram := matrix.Histogram()
+	want := map[string]int{"ff0000": 5, "00ff00": 1, "0000ff": 19}
+	if len(histogram) != len(want) {
+		t.Errorf("got %v, want %v", histogram, want)
+	}
+	for hex, count := range want {
+		if histogram[hex] != count {
+			t.Errorf("%s: %d pixels, want %d", hex, histogram[hex], count)
+		}
+	}
+
+	if got := matrix.DominantColor(); got.Value != 0x0000FF {
+		t.Errorf("dominant color %#06x, want blue", got.Value)
+	}
+
+	// Ties go to the color seen first
+	tie := ColorMatrix{Colors: []Color{{Value: 0x00FF00}, {Value: 0xFF0000}, {Value: 0xFF0000}, {Value: 0x00FF00}}}
+	if got := tie.DominantColor(); got.Value != 0x00FF00 {
+		t.Errorf("tie went to %#06x, want green", got.Value)
+	}
+}
+
+func TestStartSceneFlowPayload(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	flow := []FlowState{
+		{Duration: 1000, Mode: FlowModeColor, Value: 0xFF0000, Brightness: 100},
+		{Duration: 500, Mode: FlowModeTemp, Value: 2700, Brightness: 10},
+	}
+	if err := yl.StartSceneFlow(flow, 3, CfActionOff); err != nil {
+		t.Fatalf("StartSceneFlow failed: %v", err)
+	}
+	if got := lamp.methods(); len(got) != 1 || got[0] != "set_scene" {
+		t.Fatalf("sent %v, want a single set_scene", got)
+	}
+	if got, want := lamp.lastParams(t), `["cf",3,2,"1000,1,16711680,100,500,2,2700,10"]`; got != want {
+		t.Errorf("sent params %s, want %s", got, want)
+	}
+
+	if err := yl.StartSceneFlow(nil, 0, CfActionRecover); err == nil {
+		t.Error("an empty flow was accepted")
+	}
+	if got := len(lamp.received()); got != 1 {
+		t.Errorf("sent %d commands, an invalid flow must not be sent", got)
+	}
+}
+
+func TestPropertiesAsStringsOrNumbers(t *testing.T) {
+	for _, result := range []string{`"result":["40","4000","on"]`, `"result":[40,4000,"on"]`} {
+		lamp := newMockLamp(t)
+		yl := lamp.client()
+
+		lamp.reply("get_prop", result)
+		properties, err := yl.GetPropertiesMap([]string{"bright", "ct", "power"})
+		if err != nil {
+			t.Fatalf("%s: GetPropertiesMap failed: %v", result, err)
+		}
+		if properties["bright"] != "40" || properties["ct"] != "4000" || properties["power"] != "on" {
+			t.Errorf("%s: got %v", result, properties)
+		}
+
+		lamp.reply("get_prop", strings.Replace(result, "40", "75", 1))
+		if bright, err := yl.GetBright(); err != nil || bright != 75 {
+			t.Errorf("%s: bright %d, %v, want 75", result, bright, err)
+		}
+
+		lamp.reply("get_prop", strings.Replace(result, "40", "2700", 1))
+		if ct, err := yl.GetColorTemperature(); err != nil || ct != 2700 {
+			t.Errorf("%s: ct %d, %v, want 2700", result, ct, err)
+		}
+	}
+
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+	for _, result := range []string{`"result":[40.5]`, `"result":["bright"]`, `"result":[true]`, `"result":[]`} {
+		lamp.reply("get_prop", result)
+		if _, err := yl.GetColorTemperature(); err == nil {
+			t.Errorf("%s was accepted", result)
+		}
+	}
+	lamp.reply("get_prop", `"result":[150]`)
+	if _, err := yl.GetBright(); err == nil {
+		t.Error("bright 150 was accepted")
+	}
+}
+
+func TestQuantizeSnapsToPalette(t *testing.T) {
+	matrix := ColorMatrix{Colors: []Color{{Value: 0xF01008}, {Value: 0x101010}, {Value: 0x10E0F0}}}
+	matrix.Quantize(nil)
+
+	for i, want := range []int64{0xFF0000, 0x000000, 0x00FFFF} {
+		if got := matrix.Colors[i].Value; got != want {
+			t.Errorf("pixel %d snapped to %#06x, want %#06x", i, got, want)
+		}
+	}
+
+	custom := ColorMatrix{Colors: []Color{{Value: 0xF01008}}}
+	custom.Quantize([]Color{{Value: 0x0000FF}, {Value: 0xFFFF00}})
+	if got := custom.Colors[0].Value; got != 0xFFFF00 {
+		t.Errorf("near red snapped to %#06x with a blue and yellow palette, want yellow", got)
+	}
+}
+
+func TestSubMatrixAndPaste(t *testing.T) {
+	matrix := MakeMatrix("#000000", 25)
+	matrix.SetHex(Vector{Row: 1, Column: 1}, "#ff0000")
+	matrix.SetHex(Vector{Row: 1, Column: 2}, "#00ff00")
+	matrix.SetHex(Vector{Row: 2, Column: 1}, "#0000ff")
+	matrix.SetHex(Vector{Row: 2, Column: 2}, "#ffffff")
+
+	region := matrix.SubMatrix(1, 1, 2, 2)
+	if region.Width != 2 || len(region.Colors) != 4 {
+		t.Fatalf("region has %d pixels in %d columns, want 4 in 2", len(region.Colors), region.Width)
+	}
+	var got []string
+	for _, color := range region.Colors {
+		got = append(got, color.ToHex())
+	}
+	if want := []string{"ff0000", "00ff00", "0000ff", "ffffff"}; !slices.Equal(got, want) {
+		t.Errorf("region is %v, want %v", got, want)
+	}
+
+	// Pasting into the bottom right corner clips nothing, one step further
+	// keeps only the top left pixel
+	target := MakeMatrix("#000000", 25)
+	target.Paste(region, 3, 3)
+	for v, want := range map[Vector]string{{Row: 3, Column: 3}: "#ff0000", {Row: 3, Column: 4}: "#00ff00", {Row: 4, Column: 3}: "#0000ff", {Row: 4, Column: 4}: "#ffffff", {Row: 2, Column: 2}: "#000000"} {
+		if got := pixel(target, v.Column, v.Row); got != want {
+			t.Errorf("pasted %+v is %s, want %s", v, got, want)
+		}
+	}
+
+	clipped := MakeMatrix("#000000", 25)
+	clipped.Paste(region, 4, 4)
+	if got := clipped.Histogram(); got["ff0000"] != 1 || got["000000"] != 24 {
+		t.Errorf("clipped paste gave %v, want a single red pixel", got)
+	}
+
+	if empty := matrix.SubMatrix(5, 5, 7, 7); len(empty.Colors) != 0 {
+		t.Errorf("region outside the matrix has %d pixels", len(empty.Colors))
+	}
+}
+
+func TestGammaCorrect(t *testing.T) {
+	matrix := ColorMatrix{Colors: []Color{{Value: 0x808080}, {Value: 0x000000}, {Value: 0xFFFFFF}}}
+	matrix.GammaCorrect(2.2)
+
+	// 255*(128/255)^2.2 = 55.98
+	for i, want := range []int64{0x383838, 0x000000, 0xFFFFFF} {
+		if got := matrix.Colors[i].Value; got != want {
+			t.Errorf("pixel %d is %#06x, want %#06x", i, got, want)
+		}
+	}
+}
+
+func TestSetMatrixAppliesGamma(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+	yl.Gamma = 2.2
+
+	if err := yl.SetMatrix([]ColorMatrix{MakeMatrix("#808080", DefaultLEDCount)}); err != nil {
+		t.Fatalf("SetMatrix failed: %v", err)
+	}
+	want := MakeMatrix("#383838", DefaultLEDCount)
+	if got := lamp.lastParams(t); got != `["`+want.ToASCII()+`"]` {
+		t.Errorf("sent %s, want the corrected midpoint", got)
+	}
+}
+
+func TestRGBRoundTrip(t *testing.T) {
+	var color Color
+	color.RGB(200, 150, 255)
+
+	if r, g, b := color.ToRGB(); r != 200 || g != 150 || b != 255 {
+		t.Errorf("got %d,%d,%d, want 200,150,255", r, g, b)
+	}
+	if got := color.ToHex(); got != "c896ff" {
+		t.Errorf("got %s, want c896ff", got)
+	}
+
+	red := MakeColorRGB(255, 0, 0)
+	if red.Value != 0xFF0000 {
+		t.Errorf("MakeColorRGB(255, 0, 0) is %#x", red.Value)
+	}
+}
+
+func TestLampErrors(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	lamp.reply("set_power", `"error":{"code":-1,"message":"client quota exceeded"}`)
+	if err := yl.SetOn(DefaultOptions); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("quota: got %v, want ErrQuotaExceeded", err)
+	}
+
+	lamp.reply("set_power", `"error":{"code":-5000,"message":"general error"}`)
+	err := yl.SetOn(DefaultOptions)
+	var lampErr *YeelightError
+	if !errors.As(err, &lampErr) || lampErr.Code != -5000 || lampErr.Message != "general error" {
+		t.Errorf("got %v, want a YeelightError with code -5000", err)
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("%v was taken for a quota error", err)
+	}
+}
+
+func TestWhiteRGBInt(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	if err := yl.SetRGBInt(0xFFFFFF, DefaultOptions); err != nil {
+		t.Fatalf("SetRGBInt failed: %v", err)
+	}
+	if got, want := lamp.lastParams(t), `[16777215,"smooth",200]`; got != want {
+		t.Errorf("sent params %s, want %s", got, want)
+	}
+	if err := yl.SetRGBInt(0x1000000, DefaultOptions); err == nil {
+		t.Error("0x1000000 was accepted")
+	}
+
+	for _, result := range []string{`"result":["16777215"]`, `"result":[16777215]`} {
+		lamp.reply("get_prop", result)
+		if hex, err := yl.GetHexColor(); err != nil || hex != "ffffff" {
+			t.Errorf("%s: got %q, %v, want ffffff", result, hex, err)
+		}
+		if r, g, b, err := yl.GetRGB(); err != nil || r != 255 || g != 255 || b != 255 {
+			t.Errorf("%s: got %d,%d,%d, %v, want 255,255,255", result, r, g, b, err)
+		}
+	}
+
+	lamp.reply("get_prop", `"result":["16777216"]`)
+	if _, err := yl.GetHexColor(); !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("out of range rgb: got %v, want ErrInvalidResponse", err)
+	}
+}
+
+func TestRotateAtCorner(t *testing.T) {
+	matrix := MakeMatrix("#000000", DefaultLEDCount)
+	matrix.SetHex(Vector{Row: 0, Column: 0}, "#ff0000")
+
+	// 90° turns clockwise on the lamp, rows grow downwards
+	tests := []struct {
+		angle float64
+		want  Vector
+	}{
+		{90, Vector{Row: 0, Column: 4}},
+		{180, Vector{Row: 4, Column: 4}},
+		{270, Vector{Row: 4, Column: 0}},
+		{-90, Vector{Row: 4, Column: 0}},
+	}
+
+	for _, test := range tests {
+		rotated := matrix.RotateAt(test.angle, Vector{Row: 2, Column: 2})
+		for i, color := range rotated.Colors {
+			lit := color.Value != 0
+			if want := i == test.want.Row*5+test.want.Column; lit != want {
+				t.Errorf("%v°: LED %d lit %v, want the corner at %+v only", test.angle, i, lit, test.want)
+			}
+		}
+	}
+}
+
+func TestAdjustParams(t *testing.T) {
+	tests := []struct {
+		adjust func(yl *Yeelight) error
+		want   string
+	}{
+		{func(yl *Yeelight) error { return yl.AdjustBright(AdjustIncrease) }, `["increase","bright"]`},
+		{func(yl *Yeelight) error { return yl.AdjustBright(AdjustDecrease) }, `["decrease","bright"]`},
+		{func(yl *Yeelight) error { return yl.AdjustCT(AdjustCircle) }, `["circle","ct"]`},
+		{func(yl *Yeelight) error { return yl.AdjustColor(AdjustCircle) }, `["circle","color"]`},
+		{func(yl *Yeelight) error { return yl.AdjustBrightPercent(-20, time.Second) }, `[-20,1000]`},
+		{func(yl *Yeelight) error { return yl.AdjustBrightPercent(15, 0) }, `[15,200]`},
+	}
+
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+	for _, test := range tests {
+		if err := test.adjust(yl); err != nil {
+			t.Errorf("%s: %v", test.want, err)
+			continue
+		}
+		if got := lamp.lastParams(t); got != test.want {
+			t.Errorf("sent params %s, want %s", got, test.want)
+		}
+	}
+}
+
+func TestAdjustRejectsInvalidArguments(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	invalid := map[string]error{
+		"bright up":        yl.AdjustBright("up"),
+		"bright empty":     yl.AdjustBright(""),
+		"bright uppercase": yl.AdjustBright("INCREASE"),
+		"ct toggle":        yl.AdjustCT("toggle"),
+		"color increase":   yl.AdjustColor(AdjustIncrease),
+		"color decrease":   yl.AdjustColor(AdjustDecrease),
+		"percent 101":      yl.AdjustBrightPercent(101, time.Second),
+		"percent -101":     yl.AdjustBrightPercent(-101, time.Second),
+		"duration 10ms":    yl.AdjustBrightPercent(10, 10*time.Millisecond),
+	}
+	for name, err := range invalid {
+		if err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+	if got := lamp.methods(); len(got) != 0 {
+		t.Errorf("invalid calls sent %v", got)
+	}
+}
+
+func TestSetMatrixChainedModules(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	red, blue := MakeMatrix("#ff0000", DefaultLEDCount), MakeMatrix("#0000ff", DefaultLEDCount)
+	if err := yl.SetMatrix([]ColorMatrix{red, blue}); err != nil {
+		t.Fatalf("SetMatrix with two modules failed: %v", err)
+	}
+	if got, want := lamp.lastParams(t), `["`+red.ToASCII()+blue.ToASCII()+`"]`; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+
+	if err := yl.SetASCII(red.ToASCII() + blue.ToASCII()); err == nil {
+		t.Error("SetASCII accepted two modules")
+	}
+	if err := yl.SetMatrix([]ColorMatrix{red, MakeMatrix("#0000ff", 10)}); err == nil {
+		t.Error("SetMatrix accepted a short module")
+	}
+	if err := yl.SetMatrix(nil); err == nil {
+		t.Error("SetMatrix accepted no matrix")
+	}
+}
+
+func TestConcurrentCommandsPerConnection(t *testing.T) {
+	lamp := newMockLamp(t)
+	lamp.reply("get_prop", `"result":["50"]`)
+	yl := &Yeelight{Address: lamp.client().Address}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := yl.GetBright(); err != nil {
+				t.Errorf("GetBright failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(lamp.received()); got != 20 {
+		t.Errorf("lamp received %d commands, want 20", got)
+	}
+	// The defaults are used without being written to the shared client
+	if yl.Conn != nil || yl.ConnectTimeout != 0 || yl.ResponseTimeout != 0 {
+		t.Errorf("sending changed the client: conn %v, timeouts %s and %s", yl.Conn, yl.ConnectTimeout, yl.ResponseTimeout)
+	}
+}
+
+func TestOnlyIdempotentCommandsAreResent(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+	yl.ResponseTimeout = 50 * time.Millisecond
+	yl.TimeoutRetries = 1
+	lamp.reply("toggle", "")
+	lamp.reply("set_power", "")
+
+	if err := yl.Toggle(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("toggle: got %v, want ErrTimeout", err)
+	}
+	if got := countMethod(lamp.methods(), "toggle"); got != 1 {
+		t.Errorf("sent toggle %d times, want it sent once", got)
+	}
+
+	if err := yl.SetOn(DefaultOptions); !errors.Is(err, ErrTimeout) {
+		t.Errorf("set_power: got %v, want ErrTimeout", err)
+	}
+	if got := countMethod(lamp.methods(), "set_power"); got != 2 {
+		t.Errorf("sent set_power %d times, want it resent once", got)
+	}
+}
+
+func TestBrightnessFollowsRegions(t *testing.T) {
+	matrix := MakeMatrix("#ff0000", DefaultLEDCount)
+	matrix.SetBrightness(Vector{Row: 1, Column: 1}, 0)
+
+	region := matrix.SubMatrix(1, 1, 2, 2)
+	if got := region.ToHexSlice(); got[0] != "#000000" || got[1] != "#ff0000" {
+		t.Errorf("region is %v, want its top left pixel off", got)
+	}
+
+	target := MakeMatrix("#00ff00", DefaultLEDCount)
+	target.Paste(region, 0, 0)
+	if got := target.ToHexSlice(); got[0] != "#000000" || got[1] != "#ff0000" || got[2] != "#00ff00" {
+		t.Errorf("pasted matrix starts with %v, want the region's displayed colors", got[:3])
+	}
+
+	if got := matrix.Histogram(); got["000000"] != 1 || got["ff0000"] != 24 {
+		t.Errorf("histogram %v, want the switched off pixel counted as black", got)
+	}
+	full := MakeMatrix("#ff0000", DefaultLEDCount)
+	changes := full.Diff(matrix)
+	if len(changes) != 1 || changes[Vector{Row: 1, Column: 1}].Value != 0 {
+		t.Errorf("diff %v, want the switched off pixel only", changes)
+	}
+}
+
+func TestSleepSendsItsArgumentUnchecked(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	for _, minutes := range []int8{0, -5, 30} {
+		if err := yl.Sleep(minutes); err != nil {
+			t.Fatalf("Sleep(%d) failed: %v", minutes, err)
+		}
+		if got, want := lamp.lastParams(t), fmt.Sprintf("[0,%d]", minutes); got != want {
+			t.Errorf("sent params %s, want %s", got, want)
+		}
+	}
+}
+
+func TestPowerOnOffIsUnsupported(t *testing.T) {
+	lamp := newMockLamp(t)
+	yl := lamp.client()
+
+	err := yl.SetPowerOnBehavior(PowerOnOff)
+	if !errors.Is(err, ErrUnsupported) || !strings.Contains(err.Error(), "staying off") {
+		t.Errorf("got %v, want ErrUnsupported explaining the lamp can't stay off", err)
+	}
+	if got := lamp.methods(); len(got) != 0 {
+		t.Errorf("sent %v", got)
+	}
+}